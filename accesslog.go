@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/kzub/trickyproxy/endpoint"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type accessKey struct{}
+
+// accessRecord collects facts about one client request while it is served
+type accessRecord struct {
+	retries      int64 // atomic, first for 64-bit alignment; upstream retries and donor failovers
+	start        time.Time
+	id           string
+	outcome      proxyOutcome
+	donor        string
+	targetStatus int
+	donorStatus  int
+	storeStatus  int
+	bytesIn      int64
+	bytesOut     int64
+	targetTime   time.Duration
+	donorTime    time.Duration
+	storeTime    time.Duration
+}
+
+// newAccessLogger builds unsampled logger writing to output: stdout, stderr or file path
+func newAccessLogger(format, output string) (*zap.Logger, error) {
+	if output == "" {
+		return nil, nil
+	}
+	cfg := zap.NewProductionConfig()
+	cfg.Sampling = nil
+	cfg.Encoding = format
+	cfg.EncoderConfig.TimeKey = "@timestamp"
+	cfg.EncoderConfig.MessageKey = "message"
+	cfg.EncoderConfig.CallerKey = ""
+	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	cfg.OutputPaths = []string{output}
+	return cfg.Build()
+}
+
+// startAccessRecord attaches a new record to the request, X-Request-Id is kept or generated
+func startAccessRecord(w http.ResponseWriter, r *http.Request) (*accessWriter, *http.Request, *accessRecord) {
+	rec := &accessRecord{start: time.Now(), id: r.Header.Get("X-Request-Id")}
+	if rec.id == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		rec.id = hex.EncodeToString(id)
+	}
+	w.Header().Set("X-Request-Id", rec.id)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReader{ReadCloser: r.Body, n: &rec.bytesIn}
+	}
+	ctx := context.WithValue(r.Context(), accessKey{}, rec)
+	r = r.WithContext(endpoint.WithRetryCounter(ctx, &rec.retries))
+	return &accessWriter{ResponseWriter: w, n: &rec.bytesOut}, r, rec
+}
+
+// accessRecordFrom returns record of the request, a throwaway one if there is none
+func accessRecordFrom(r *http.Request) *accessRecord {
+	if rec, ok := r.Context().Value(accessKey{}).(*accessRecord); ok {
+		return rec
+	}
+	return &accessRecord{}
+}
+
+func (rec *accessRecord) targetDone(status int, start time.Time) {
+	rec.targetStatus = status
+	rec.targetTime += time.Since(start)
+}
+
+func (rec *accessRecord) donorDone(donor string, status int, start time.Time) {
+	rec.donor = donor
+	rec.donorStatus = status
+	rec.donorTime += time.Since(start)
+}
+
+func (rec *accessRecord) stored(status int, start time.Time) {
+	rec.storeStatus = status
+	rec.storeTime += time.Since(start)
+}
+
+// accessOutcome groups detailed outcomes for the access log
+func accessOutcome(outcome proxyOutcome) string {
+	switch outcome {
+	case outcomeTargetHit:
+		return "TARGET_HIT"
+	case outcomeDonorFill:
+		return "DONOR_FILL"
+	case outcomeDonorMiss, outcomeNegativeHit, outcomeTombstone:
+		return "DONOR_MISS" // a cached donor 404 or a deleted key is a miss too
+	case outcomeStoplist:
+		return "STOPLIST"
+	case outcomeNoProxy:
+		return "NOPROXY"
+	case outcomeClientGone:
+		return "CLIENT_GONE"
+	}
+	return "ERROR"
+}
+
+// logAccess writes the record to logger, vspace is the target one
+func logAccess(logger *zap.Logger, r *http.Request, rec *accessRecord, vspace string) {
+	if logger == nil {
+		return
+	}
+	logger.Info("access",
+		zap.String("request_id", rec.id),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.RequestURI()),
+		zap.String("vspace", vspace),
+		zap.String("outcome", accessOutcome(rec.outcome)),
+		zap.String("outcome_detail", strings.ToUpper(string(rec.outcome))),
+		zap.String("donor", rec.donor),
+		zap.Int64("retries", atomic.LoadInt64(&rec.retries)),
+		zap.Int("target_status", rec.targetStatus),
+		zap.Int("donor_status", rec.donorStatus),
+		zap.Int("store_status", rec.storeStatus),
+		zap.Int64("bytes_in", rec.bytesIn),
+		zap.Int64("bytes_out", rec.bytesOut),
+		zap.Duration("target_time", rec.targetTime),
+		zap.Duration("donor_time", rec.donorTime),
+		zap.Duration("store_time", rec.storeTime),
+		zap.Duration("total_time", time.Since(rec.start)),
+	)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// accessWriter counts bytes written to the client
+type accessWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (a *accessWriter) Write(p []byte) (int, error) {
+	n, err := a.ResponseWriter.Write(p)
+	*a.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAccessOutcome(t *testing.T) {
+	tests := map[proxyOutcome]string{
+		outcomeTargetHit:       "TARGET_HIT",
+		outcomeDonorFill:       "DONOR_FILL",
+		outcomeDonorMiss:       "DONOR_MISS",
+		outcomeNegativeHit:     "DONOR_MISS",
+		outcomeTombstone:       "DONOR_MISS",
+		outcomeNoProxy:         "NOPROXY",
+		outcomeStoplist:        "STOPLIST",
+		outcomeClientGone:      "CLIENT_GONE",
+		outcomeDonorStreamFail: "ERROR",
+	}
+	for outcome, want := range tests {
+		if got := accessOutcome(outcome); got != want {
+			t.Errorf("accessOutcome(%s) = %s, want %s", outcome, got, want)
+		}
+	}
+}
+
+func TestAccessLogCountsUpstreamRetries(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	opts := newSettings()
+	opts.accessLogger = zap.New(core)
+
+	var calls int32
+	donor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close() // transport error, the donor request is repeated
+			return
+		}
+		io.WriteString(w, "hello")
+	})
+	proxy := startTestProxy(t, "http", opts, newFakeStore(nil), donor, RulesConfig{})
+
+	resp, err := http.Get(proxy.URL + "/x/k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for start := time.Now(); logs.FilterMessage("access").Len() == 0 && time.Since(start) < time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries := logs.FilterMessage("access").All()
+	if len(entries) != 1 {
+		t.Fatalf("got %d access records, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["retries"] != int64(1) || fields["outcome"] != "DONOR_FILL" {
+		t.Errorf("got retries %v, outcome %v, want 1 and DONOR_FILL", fields["retries"], fields["outcome"])
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/kzub/trickyproxy/endpoint"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// adminAPI is JSON API to inspect and steer running proxy, served on its own listener
+type adminAPI struct {
+	token    string
+	mode     string
+	reloader *rulesReloader
+	target   *endpoint.Instance
+	vspace   string
+	// missCache is shown in stats, nil when disabled
+	missCache *negativeCache
+}
+
+// startAdmin serves admin API in background, the returned server is closed on shutdown
+func startAdmin(addr string, api *adminAPI) *http.Server {
+	server := &http.Server{Addr: addr, Handler: api.handler()}
+	go func() {
+		zap.L().Info("admin api ready",
+			zap.String("address", addr),
+		)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			zap.L().Error("cannot setup admin api",
+				zap.String("address", addr),
+				zap.String("error", err.Error()),
+			)
+		}
+	}()
+	return server
+}
+
+func (api *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/donors", api.auth("GET", api.donors))
+	mux.HandleFunc("/donors/", api.auth("POST", api.setDonor))
+	mux.HandleFunc("/target", api.auth("GET", api.targetInfo))
+	mux.HandleFunc("/rules", api.auth("GET", api.rules))
+	mux.HandleFunc("/reload", api.auth("POST", api.reload))
+	mux.HandleFunc("/stats", api.auth("GET", api.stats))
+	return mux
+}
+
+// auth checks "Authorization: Bearer <token>" and the method
+func (api *adminAPI) auth(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "BAD_ADMIN_TOKEN"})
+			return
+		}
+		if r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "METHOD_NOT_ALLOWED"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (api *adminAPI) donors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.reloader.Current().donors.Stats())
+}
+
+// setDonor handles POST /donors/<host:port>/enable and /donors/<host:port>/disable
+func (api *adminAPI) setDonor(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/donors/"), "/")
+	if len(parts) != 2 || (parts[1] != "enable" && parts[1] != "disable") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "UNKNOWN_ACTION"})
+		return
+	}
+	name, enabled := parts[0], parts[1] == "enable"
+	if !api.reloader.Current().donors.SetEnabled(name, enabled) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "UNKNOWN_DONOR"})
+		return
+	}
+	zap.L().Info("donor changed by admin api",
+		zap.String("donor", name),
+		zap.Bool("enabled", enabled),
+	)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "enabled": enabled})
+}
+
+func (api *adminAPI) targetInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"name":   api.target.Name(),
+		"vspace": api.vspace,
+		"mode":   api.mode,
+	})
+}
+
+func (api *adminAPI) rules(w http.ResponseWriter, r *http.Request) {
+	config := api.reloader.Current().config
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"noproxy":      config.NoProxy,
+		"stoplist":     config.StopList,
+		"readonlypost": config.ReadOnlyPost,
+	})
+}
+
+func (api *adminAPI) reload(w http.ResponseWriter, r *http.Request) {
+	if err := api.reloader.Reload(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"donors": api.reloader.Current().donors.Len()})
+}
+
+func (api *adminAPI) stats(w http.ResponseWriter, r *http.Request) {
+	outcomeCounts.Lock()
+	outcomes := make(map[proxyOutcome]int64, len(outcomeCounts.counts))
+	for outcome, count := range outcomeCounts.counts {
+		outcomes[outcome] = count
+	}
+	outcomeCounts.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"active_requests": atomic.LoadInt64(&activeRequests),
+		"outcomes":        outcomes,
+		"negative_cache":  api.missCache.Len(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
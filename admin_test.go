@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/kzub/trickyproxy/endpoint"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testConfigLoader returns config of donors, the list may be changed between reloads
+func testConfigLoader(donors *[]string) func() (*Config, error) {
+	return func() (*Config, error) {
+		cfg := &Config{}
+		for _, donor := range *donors {
+			cfg.Donors = append(cfg.Donors, DonorConfig{
+				URL:       donor,
+				Weight:    1,
+				Transport: TransportConfig(endpoint.DefaultTransportConfig),
+				Retry:     RetryConfig(endpoint.DefaultRetryPolicy),
+			})
+		}
+		return cfg, nil
+	}
+}
+
+// startTestReloader returns reloader of the config load gives, donors of the active rules are closed after the test
+func startTestReloader(t *testing.T, load func() (*Config, error)) *rulesReloader {
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := buildProxyRules(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := newRulesReloader(rules, load)
+	t.Cleanup(func() { reloader.Current().donors.Close() })
+	return reloader
+}
+
+func TestAdminAPI(t *testing.T) {
+	donors := []string{"http://127.0.0.1:8001", "http://127.0.0.1:8002"}
+	api := &adminAPI{token: "secret", mode: "riak", reloader: startTestReloader(t, testConfigLoader(&donors)), target: endpoint.New("127.0.0.1", "8098", "http", "", nil, nil, nil)}
+	handler := api.handler()
+
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"no token", "", "GET", "/donors", http.StatusUnauthorized},
+		{"bad token", "wrong", "GET", "/donors", http.StatusUnauthorized},
+		{"bad token before method", "wrong", "POST", "/donors", http.StatusUnauthorized},
+		{"wrong method", "secret", "POST", "/donors", http.StatusMethodNotAllowed},
+		{"get on action", "secret", "GET", "/donors/127.0.0.1:8001/disable", http.StatusMethodNotAllowed},
+		{"donors", "secret", "GET", "/donors", http.StatusOK},
+		{"unknown action", "secret", "POST", "/donors/127.0.0.1:8001/drop", http.StatusNotFound},
+		{"unknown donor", "secret", "POST", "/donors/127.0.0.1:9999/disable", http.StatusNotFound},
+		{"disable", "secret", "POST", "/donors/127.0.0.1:8001/disable", http.StatusOK},
+		{"target", "secret", "GET", "/target", http.StatusOK},
+		{"stats", "secret", "GET", "/stats", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("%s %s got %d %s, want %d", tt.method, tt.path, w.Code, w.Body.String(), tt.wantStatus)
+			}
+		})
+	}
+
+	enabled := func() map[string]bool {
+		states := make(map[string]bool)
+		for _, donor := range api.reloader.Current().donors.Stats() {
+			states[donor.Name] = donor.Enabled
+		}
+		return states
+	}
+	if states := enabled(); states["127.0.0.1:8001"] || !states["127.0.0.1:8002"] {
+		t.Fatalf("got %v, want 127.0.0.1:8001 disabled", states)
+	}
+
+	// a reload with a new donor list keeps the donor disabled
+	donors = append(donors, "http://127.0.0.1:8003")
+	r := httptest.NewRequest("POST", "/reload", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reload got %d %s", w.Code, w.Body.String())
+	}
+	if states := enabled(); len(states) != 3 || states["127.0.0.1:8001"] || !states["127.0.0.1:8003"] {
+		t.Errorf("after reload got %v, want 127.0.0.1:8001 still disabled", states)
+	}
+}
@@ -1,38 +1,106 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/kzub/trickyproxy/endpoint"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
-var riakSecondaryIndexSearch *regexp.Regexp
+// riakSecondaryIndexSearch matches 2i queries of plain and typed buckets: [/types/<type>]/buckets/<bucket>/index/
+var riakSecondaryIndexSearch = regexp.MustCompile("^(/types/[^/]+)?/buckets/([^/]+)/index/")
+
+// riak2iBackfills are background 2i backfills waited for on shutdown
+var riak2iBackfills sync.WaitGroup
+
+// Mode describes how the proxy detects misses and copies data from donors to the target
+type Mode interface {
+	// IsNeedProxyPass tells if a donor is asked, body reads the whole target response and is called only when needed
+	IsNeedProxyPass(resp *http.Response, r *http.Request, body func() ([]byte, error)) bool
+	PostProcess(donor, target *endpoint.Instance, resp *http.Response, r *http.Request, body *spoolBuffer) (storeResult bool, err error)
+	URLEncoder(space string) endpoint.URLModifier
+	HeaderEncoder(space string) endpoint.HeaderModifier
+	HeaderDecoder(space string) endpoint.HeaderModifier
+	RewriteRequest(donors *endpoint.Instances, target *endpoint.Instance, r *http.Request) *http.Request
+	// RewriteResponse changes target response before the client gets it, body is read only when needed
+	RewriteResponse(target *endpoint.Instance, resp *http.Response, r *http.Request, body *lazyBody) error
+	CopyKey(ctx context.Context, donor, target *endpoint.Instance, keyPath string) (stored bool, err error)
+}
 
-// -- DEFAULT ---------------------------------------------
-var isNeedProxyPass = isNeedProxyPassDefault
-var postProcess = postProcessDefault
-var urlEncoder = urlNoEncoder
-var headerEncoder = headerNoEncoder
-var headerDecoder = headerNoEncoder
+var modes = make(map[string]func(opts *settings) Mode)
 
-func setRiakProxyMode() {
-	var err error
-	riakSecondaryIndexSearch, err = regexp.Compile("^/buckets/.*/index/")
+func init() {
+	registerMode("http", func(opts *settings) Mode { return httpMode{opts: opts} })
+	registerMode("riak", func(opts *settings) Mode { return riakMode{opts: opts} })
+}
 
-	if err != nil {
-		panic("setRiakProxyMode, cannot compile regexp")
+// registerMode makes mode available for the -mode flag, newMode builds it with the settings of the run
+func registerMode(name string, newMode func(opts *settings) Mode) {
+	if _, exists := modes[name]; exists {
+		panic("registerMode, mode already registered: " + name)
+	}
+	modes[name] = newMode
+}
+
+func getMode(name string, opts *settings) (Mode, error) {
+	newMode, ok := modes[name]
+	if !ok {
+		return nil, errors.New("UNKNOWN_MODE " + name)
+	}
+	return newMode(opts), nil
+}
+
+func modeNames() []string {
+	var names []string
+	for name := range modes {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	isNeedProxyPass = isNeedProxyPassRiak
-	postProcess = postProcessRiak
-	urlEncoder = riakURLEncoder
-	headerEncoder = riakHeaderEncoder
-	headerDecoder = riakHeaderDecoder
+// -- DEFAULT ---------------------------------------------
+type httpMode struct {
+	opts *settings
+}
+
+func (httpMode) IsNeedProxyPass(resp *http.Response, r *http.Request, body func() ([]byte, error)) bool {
+	return isNeedProxyPassDefault(resp, r)
+}
+func (m httpMode) PostProcess(donor, target *endpoint.Instance, resp *http.Response, r *http.Request, body *spoolBuffer) (bool, error) {
+	return postProcessDefault(m, m.opts, donor, target, resp, r, body)
+}
+func (httpMode) URLEncoder(space string) endpoint.URLModifier {
+	return urlNoEncoder(space)
+}
+func (httpMode) HeaderEncoder(space string) endpoint.HeaderModifier {
+	return headerNoEncoder(space)
+}
+func (httpMode) HeaderDecoder(space string) endpoint.HeaderModifier {
+	return headerNoEncoder(space)
+}
+func (httpMode) RewriteRequest(donors *endpoint.Instances, target *endpoint.Instance, r *http.Request) *http.Request {
+	return r
+}
+func (httpMode) RewriteResponse(target *endpoint.Instance, resp *http.Response, r *http.Request, body *lazyBody) error {
+	return nil
+}
+func (m httpMode) CopyKey(ctx context.Context, donor, target *endpoint.Instance, keyPath string) (bool, error) {
+	return copyKey(ctx, m.opts, donor, target, keyPath)
 }
 
 func urlNoEncoder(space string) endpoint.URLModifier {
@@ -42,7 +110,44 @@ func headerNoEncoder(space string) endpoint.HeaderModifier {
 	return getHeaderCoder(replacerFunc(nil, ""))
 }
 
-func isNeedProxyPassDefault(resp *http.Response, r *http.Request, body []byte) bool {
+// -- RIAK ------------------------------------------------
+type riakMode struct {
+	opts *settings
+}
+
+func (riakMode) IsNeedProxyPass(resp *http.Response, r *http.Request, body func() ([]byte, error)) bool {
+	return isNeedProxyPassRiak(resp, r, body)
+}
+func (m riakMode) PostProcess(donor, target *endpoint.Instance, resp *http.Response, r *http.Request, body *spoolBuffer) (bool, error) {
+	return postProcessRiak(m, m.opts, donor, target, resp, r, body)
+}
+func (riakMode) URLEncoder(space string) endpoint.URLModifier {
+	return riakURLEncoder(space)
+}
+func (riakMode) HeaderEncoder(space string) endpoint.HeaderModifier {
+	return riakHeaderEncoder(space)
+}
+func (riakMode) HeaderDecoder(space string) endpoint.HeaderModifier {
+	return riakHeaderDecoder(space)
+}
+func (m riakMode) RewriteRequest(donors *endpoint.Instances, target *endpoint.Instance, r *http.Request) *http.Request {
+	riakRewriteVclock(donors, target, r)
+	if r.Method == "POST" && getPathFromURL(r.URL) == "/mapred" {
+		return riakMapRed(m, m.opts, donors, target, r)
+	}
+	return r
+}
+func (riakMode) RewriteResponse(target *endpoint.Instance, resp *http.Response, r *http.Request, body *lazyBody) error {
+	if r.Method == "POST" && getPathFromURL(r.URL) == "/mapred" && resp.StatusCode == http.StatusOK {
+		return riakMapRedResult(target, resp, body)
+	}
+	return nil
+}
+func (m riakMode) CopyKey(ctx context.Context, donor, target *endpoint.Instance, keyPath string) (bool, error) {
+	return copyRiakKey(ctx, m.opts, donor, target, keyPath)
+}
+
+func isNeedProxyPassDefault(resp *http.Response, r *http.Request) bool {
 	if resp.StatusCode == http.StatusNotFound {
 		if r.Method == "GET" || r.Method == "HEAD" {
 			return true
@@ -50,13 +155,17 @@ func isNeedProxyPassDefault(resp *http.Response, r *http.Request, body []byte) b
 	}
 	return false
 }
-func isNeedProxyPassRiak(resp *http.Response, r *http.Request, body []byte) bool {
+func isNeedProxyPassRiak(resp *http.Response, r *http.Request, body func() ([]byte, error)) bool {
 	if r.Method == "GET" && resp.StatusCode == http.StatusOK && riakSecondaryIndexSearch.MatchString(getPathFromURL(r.URL)) {
-		var keys, err = getKeysFrom2iResponse(body)
+		data, err := body()
+		if err != nil {
+			return false
+		}
+		keys, _, err := parse2iResponse(resp.Header.Get("Content-Type"), data)
 		if err != nil {
 			zap.L().Error("ERROR PARSING 2i BODY (isNeedProxyPassRiak)",
 				zap.String("url", getPathFromURL(r.URL)),
-				zap.String("body", string(body)),
+				zap.String("body", string(data)),
 			)
 			return false
 		}
@@ -65,79 +174,240 @@ func isNeedProxyPassRiak(resp *http.Response, r *http.Request, body []byte) bool
 		}
 		return false
 	}
-	return isNeedProxyPassDefault(resp, r, body)
+	return isNeedProxyPassDefault(resp, r)
 }
 
-func postProcessDefault(donor, target *endpoint.Instance, resp *http.Response, r *http.Request, body []byte) (storeResult bool, err error) {
+func postProcessDefault(mode Mode, opts *settings, donor, target *endpoint.Instance, resp *http.Response, r *http.Request, body *spoolBuffer) (storeResult bool, err error) {
 	storeResult = resp.StatusCode == http.StatusOK
 	if r.Method == "HEAD" {
-		err = retrieveKey(donor, target, getPathFromURL(r.URL)) // update full key, not onlyHEAD
+		// update full key, not onlyHEAD; the donor answered, so it is copied even if the client is gone
+		_, err = retrieveKey(detach(r.Context()), mode, opts, donor, target, getPathFromURL(r.URL))
 		storeResult = false
 	}
 	return storeResult, err
 }
-func postProcessRiak(donor, target *endpoint.Instance, resp *http.Response, r *http.Request, body []byte) (storeResult bool, err error) {
+func postProcessRiak(mode Mode, opts *settings, donor, target *endpoint.Instance, resp *http.Response, r *http.Request, body *spoolBuffer) (storeResult bool, err error) {
 	if riakSecondaryIndexSearch.MatchString(getPathFromURL(r.URL)) {
-		storeSecondaryIndexeResponse(donor, target, resp, r, body)
+		data, err := body.Bytes()
+		if err != nil {
+			return false, err
+		}
+		if opts.riak2iAsync {
+			riak2iBackfills.Add(1)
+			secondaryIndexBackfills.Inc()
+			rq := r.WithContext(detach(r.Context())) // outlives the client request
+			go func() {
+				defer riak2iBackfills.Done()
+				defer secondaryIndexBackfills.Dec()
+				storeSecondaryIndexeResponse(mode, opts, donor, target, resp, rq, data)
+			}()
+			return false, nil
+		}
+		// keys are filled while the client request lasts, a client that goes away stops the fill
+		storeSecondaryIndexeResponse(mode, opts, donor, target, resp, r, data)
 		return false, nil // exit without errors (no storing second time needed)
 	}
-	return postProcessDefault(donor, target, resp, r, body)
+	path := getPathFromURL(r.URL)
+	if r.Method == "GET" && riakObjectPath.MatchString(path) &&
+		(resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusMultipleChoices) {
+		start := time.Now()
+		rq, span := startSpan(r, "store", attribute.String("peer", target.Name()))
+		status, err := storeRiakResponse(detach(rq.Context()), opts, donor, target, path, resp, body)
+		endSpan(span, status, err)
+		accessRecordFrom(r).stored(status, start)
+		return false, err
+	}
+	return postProcessDefault(mode, opts, donor, target, resp, r, body)
 }
 
-func storeSecondaryIndexeResponse(donor, target *endpoint.Instance, resp *http.Response, r *http.Request, body []byte) (err error) {
-	keys, err := getKeysFrom2iResponse(body)
+func storeSecondaryIndexeResponse(mode Mode, opts *settings, donor, target *endpoint.Instance, resp *http.Response, r *http.Request, body []byte) (err error) {
+	r, span := startSpan(r, "2i backfill", attribute.Bool("async", opts.riak2iAsync))
+	defer func() { endSpan(span, 0, err) }()
+
+	keys, continuation, err := parse2iResponse(resp.Header.Get("Content-Type"), body)
 	if err != nil {
 		return err
 	}
 
-	indexBucket, err := get2iBucket(getPathFromURL(r.URL))
+	bucketPath, err := get2iBucket(getPathFromURL(r.URL))
 	if err != nil {
 		return err
 	}
 
-	zap.L().Info("GOT 2i KEYS",
-		zap.Int("length", len(keys)),
-		zap.String("url", getPathFromURL(r.URL)),
-	)
+	for page := 1; ; page++ {
+		zap.L().Info("GOT 2i KEYS",
+			zap.Int("length", len(keys)),
+			zap.Int("page", page),
+			zap.String("url", getPathFromURL(r.URL)),
+		)
+		keyPaths := make([]string, len(keys))
+		for i, key := range keys {
+			keyPaths[i] = bucketPath + "/keys/" + url.PathEscape(key)
+		}
+		span.SetAttributes(attribute.Int("pages", page))
+		retrieveKeys(r.Context(), mode, opts, donor, target, keyPaths)
 
-	for _, key := range keys {
-		var keyPath = "/riak/" + indexBucket + "/" + key
-		err = retrieveKey(donor, target, keyPath)
+		if continuation == "" || (opts.riak2iMaxPages > 0 && page >= opts.riak2iMaxPages) {
+			return nil
+		}
+		if err = r.Context().Err(); err != nil {
+			return err
+		}
+		keys, continuation, err = getDonor2iPage(r.Context(), donor, r.URL, continuation)
 		if err != nil {
-			zap.L().Error("ERROR RETRIEVE KEY 2i",
-				zap.String("key", keyPath),
+			zap.L().Error("ERROR 2i PAGE",
+				zap.String("url", getPathFromURL(r.URL)),
 				zap.String("error", err.Error()),
 			)
+			return err
 		}
 	}
+}
 
-	return nil
+// retrieveKeys fills keys with riak2iWorkers workers and returns when all of them are done or ctx is cancelled
+func retrieveKeys(ctx context.Context, mode Mode, opts *settings, donor, target *endpoint.Instance, keyPaths []string) {
+	queue := make(chan string)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < opts.riak2iWorkers && i < len(keyPaths); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for keyPath := range queue {
+				select {
+				case opts.riak2iSlots <- struct{}{}:
+				case <-ctx.Done():
+					continue
+				}
+				retrieve2iKey(ctx, mode, opts, donor, target, keyPath)
+				<-opts.riak2iSlots
+			}
+		}()
+	}
+
+feed:
+	for _, keyPath := range keyPaths {
+		select {
+		case queue <- keyPath:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func retrieve2iKey(ctx context.Context, mode Mode, opts *settings, donor, target *endpoint.Instance, keyPath string) {
+	_, err := retrieveKey(ctx, mode, opts, donor, target, keyPath)
+	if err != nil && ctx.Err() != nil {
+		return // the fill was stopped, the key did not fail
+	}
+	if err != nil {
+		secondaryIndexKeysTotal.WithLabelValues("failed").Inc()
+		zap.L().Error("ERROR RETRIEVE KEY 2i",
+			zap.String("key", keyPath),
+			zap.String("error", err.Error()),
+		)
+		return
+	}
+	secondaryIndexKeysTotal.WithLabelValues("filled").Inc()
+}
+
+// waitBackfills waits for background 2i backfills on shutdown until deadline
+func waitBackfills(deadline time.Time) {
+	done := make(chan struct{})
+	go func() {
+		riak2iBackfills.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		select {
+		case <-done:
+		default:
+			zap.L().Error("BACKFILL_SHUTDOWN_TIMEOUT, dropping 2i backfills")
+		}
+	}
+}
+
+// getDonor2iPage repeats 2i query on the donor from the continuation
+func getDonor2iPage(ctx context.Context, donor *endpoint.Instance, rURL *url.URL, continuation string) (keys []string, next string, err error) {
+	query := rURL.Query()
+	query.Set("continuation", continuation)
+	resp, body, err := donor.GetContext(ctx, getPathFromURL(rURL)+"?"+query.Encode())
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New("DONOR_2I_PAGE " + resp.Status)
+	}
+	return parse2iResponse(resp.Header.Get("Content-Type"), body)
 }
 
-func getKeysFrom2iResponse(body []byte) (result []string, err error) {
-	var jsonData map[string][]string
+// riak2iChunk is a 2i response or one part of it with stream=true,
+// results are {term: key} pairs returned with return_terms=true
+type riak2iChunk struct {
+	Keys         []string            `json:"keys"`
+	Results      []map[string]string `json:"results"`
+	Continuation string              `json:"continuation"`
+}
 
-	if err = json.Unmarshal(body, &jsonData); err != nil {
-		return nil, err
+// parse2iResponse reads keys and continuation from plain or streamed (multipart/mixed) 2i response
+func parse2iResponse(contentType string, body []byte) (keys []string, continuation string, err error) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/mixed" {
+		return decode2iChunks(bytes.NewReader(body), keys, continuation)
 	}
 
-	for _, v := range jsonData["keys"] {
-		result = append(result, v)
+	parts := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return keys, continuation, nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if keys, continuation, err = decode2iChunks(part, keys, continuation); err != nil {
+			return nil, "", err
+		}
 	}
-	return result, nil
 }
 
-func get2iBucket(path string) (res string, err error) {
-	if res = riakSecondaryIndexSearch.FindString(path); res == "" {
-		return res, errors.New("BUCKET_NOT_FOUND get2iBucket")
+func decode2iChunks(r io.Reader, keys []string, continuation string) ([]string, string, error) {
+	decoder := json.NewDecoder(r)
+	for {
+		var data riak2iChunk
+		err := decoder.Decode(&data)
+		if err == io.EOF {
+			return keys, continuation, nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, data.Keys...)
+		for _, result := range data.Results {
+			for _, key := range result {
+				keys = append(keys, key)
+			}
+		}
+		if data.Continuation != "" {
+			continuation = data.Continuation
+		}
 	}
+}
 
-	var parts = strings.Split(res, "/")
-	if len(parts) < 3 {
-		return res, errors.New("BUCKET_NOT_FOUND get2iBucket wrong size")
+// get2iBucket returns bucket path of 2i query, bucket type included: [/types/<type>]/buckets/<bucket>
+func get2iBucket(path string) (res string, err error) {
+	var parts = riakSecondaryIndexSearch.FindStringSubmatch(path)
+	if parts == nil {
+		return res, errors.New("BUCKET_NOT_FOUND get2iBucket")
 	}
 
-	return parts[2], nil
+	return parts[1] + "/buckets/" + parts[2], nil
 }
 
 func get2iNameValue(path string) (name string, value string, err error) {
@@ -172,60 +442,132 @@ func get2iNameValue(path string) (name string, value string, err error) {
 }
 
 // -- HELP FUNCTIONS ---------------------------------------
-func storeResponse(target *endpoint.Instance, path string, headers http.Header, body []byte) (err error) {
-	resp, respBody, err := target.Post(path, headers, body)
+func logDryRun(donor, target *endpoint.Instance, method, path string, size int64) {
+	zap.L().Info("DRY_RUN store skipped",
+		zap.String("donor", donor.Name()),
+		zap.String("target", target.Name()),
+		zap.String("method", method),
+		zap.String("path", target.EncodePath(path)),
+		zap.Int64("size", size),
+	)
+}
+
+// storeResponse POSTs body to the target, status is 0 when nothing was sent
+func storeResponse(ctx context.Context, opts *settings, donor, target *endpoint.Instance, path string, headers http.Header, body *spoolBuffer) (status int, err error) {
+	if opts.dryRun {
+		logDryRun(donor, target, "POST", path, body.Len())
+		return 0, nil
+	}
+	resp, respBody, err := target.PostStreamContext(ctx, path, headers, body.Len(), body.Open)
 	if err != nil {
-		return err
+		return 0, err
 	}
-
-	if (resp.StatusCode != http.StatusOK) && (resp.StatusCode != http.StatusNoContent) {
+	if resp.StatusCode >= http.StatusMultipleChoices {
 		zap.L().Info("store status",
 			zap.String("status", resp.Status),
 			zap.String("body", string(respBody)),
 		)
-	} else {
-		zap.L().Info("store status",
-			zap.String("status", resp.Status),
-		)
+		return resp.StatusCode, errors.New("TARGET_STORE_STATUS " + resp.Status)
+	}
+	opts.missCache.Remove(negativeKey(target, path))
+
+	zap.L().Info("store status",
+		zap.String("status", resp.Status),
+	)
+	return resp.StatusCode, nil
+}
+
+// retrieveKey copies key from donor to target, concurrent calls for the same key share one copy
+func retrieveKey(ctx context.Context, mode Mode, opts *settings, donor, target *endpoint.Instance, keyPath string) (stored bool, err error) {
+	_, span := tracer.Start(ctx, "retrieve key", trace.WithAttributes(
+		attribute.String("key", keyPath),
+		attribute.String("donor", donor.Name()),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Bool("stored", stored))
+		endSpan(span, 0, err)
+	}()
+
+	if opts.tombstones.Has(tombstoneKey(target, keyPath)) {
+		return false, nil // deleted through the proxy
+	}
+	key := "RETRIEVE " + target.Name() + target.EncodePath(keyPath)
+	f, leader := keyFlights.join(key)
+	defer f.release()
+	if !leader {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		if f.err == context.Canceled && ctx.Err() == nil {
+			return mode.CopyKey(ctx, donor, target, keyPath) // the leader was abandoned
+		}
+		return f.ok, f.err
+	}
+	defer keyFlights.finish(key, f)
+
+	f.ok, f.err = mode.CopyKey(ctx, donor, target, keyPath)
+	if ctx.Err() != nil {
+		f.err = ctx.Err()
 	}
-	return
+	return f.ok, f.err
 }
 
-func retrieveKey(donor, target *endpoint.Instance, keyPath string) (err error) {
+// copyKey stores donor key on the target unless the target already has it
+func copyKey(ctx context.Context, opts *settings, donor, target *endpoint.Instance, keyPath string) (stored bool, err error) {
 	zap.L().Info("RETRIEVE KEY >>>>",
 		zap.String("key", keyPath),
 	)
-	resp, body, err := target.Get(keyPath)
+	resp, err := target.GetStreamContext(ctx, keyPath)
 	if err != nil {
-		return errors.New("TARGET_GET_KEY")
+		return false, errors.New("TARGET_GET_KEY")
 	}
+	resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
-		resp, body, err = donor.Get(keyPath)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			return errors.New("DONOR_GET_KEY")
-		}
+	if resp.StatusCode == http.StatusOK {
+		return false, nil // already there
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return false, errors.New("TARGET_GET_KEY " + resp.Status)
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		err = storeResponse(target, keyPath, resp.Header, body)
-		if err != nil {
-			return errors.New("TARGET_WRITE_KEY")
-		}
+	resp, err = donor.GetStreamContext(ctx, keyPath)
+	if err != nil {
+		return false, errors.New("DONOR_GET_KEY")
 	}
+	defer resp.Body.Close()
 
-	return nil
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil // nothing to copy
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New("DONOR_GET_KEY " + resp.Status)
+	}
+
+	spool := opts.newSpool()
+	defer spool.Close()
+	if _, err = io.Copy(spool, resp.Body); err != nil {
+		return false, errors.New("DONOR_READ_KEY")
+	}
+	_, err = storeResponse(ctx, opts, donor, target, keyPath, resp.Header, spool)
+	if err != nil {
+		return false, errors.New("TARGET_WRITE_KEY")
+	}
+
+	return true, nil
 }
 
 func riakURLEncoder(space string) endpoint.URLModifier {
 	if space == "" {
 		return replacerFunc(nil, "")
 	}
-	rexp, err := regexp.Compile("(<|^)/([^/­]+)/")
+	// bucket type is kept, space goes to the bucket: /types/<type>/buckets/<space><bucket>
+	rexp, err := regexp.Compile("(<|^)(/types/[^/­]+)?/([^/­]+)/")
 	if err != nil {
 		panic("COULD NOT MAKE REGEXP ENCODER")
 	}
-	replaceString := "$1/$2/" + space
+	replaceString := "$1$2/$3/" + space
 	return replacerFunc(rexp, replaceString)
 }
 
@@ -234,11 +576,11 @@ func riakURLDecoder(space string) endpoint.URLModifier {
 		return replacerFunc(nil, "")
 	}
 
-	rexp, err := regexp.Compile("(<|^)/([^/­]+)/" + space)
+	rexp, err := regexp.Compile("(<|^)(/types/[^/­]+)?/([^/­]+)/" + space)
 	if err != nil {
 		panic("COULD NOT MAKE REGEXP ENCODER")
 	}
-	replaceString := "$1/$2/"
+	replaceString := "$1$2/$3/"
 	return replacerFunc(rexp, replaceString)
 }
 
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCopyKeyDryRun(t *testing.T) {
+	opts := newSettings()
+	opts.dryRun = true
+	tests := []struct {
+		name string
+		mode Mode
+		key  string
+	}{
+		{"http", httpMode{opts: opts}, "/x/k1"},
+		{"riak", riakMode{opts: opts}, "/buckets/b/keys/k1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newFakeStore(nil)
+			donor := newFakeStore(map[string]string{tt.key: "hello"})
+			targetInstance, donors := startTestUpstreams(t, tt.mode, target, donor, nil)
+			donorInstance, err := donors.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = tt.mode.CopyKey(context.Background(), donorInstance, targetInstance, tt.key); err != nil {
+				t.Fatal(err)
+			}
+			target.mutex.Lock()
+			defer target.mutex.Unlock()
+			for _, request := range target.requests {
+				if !strings.HasPrefix(request, "GET ") && !strings.HasPrefix(request, "HEAD ") {
+					t.Errorf("dry run sent %s to the target", request)
+				}
+			}
+		})
+	}
+}
+
+func TestParse2iResponse(t *testing.T) {
+	multipart := "\r\n--b1\r\nContent-Type: application/json\r\n\r\n" + `{"keys":["k1","k2"]}` +
+		"\r\n--b1\r\nContent-Type: application/json\r\n\r\n" + `{"keys":["k3"]}` +
+		"\r\n--b1\r\nContent-Type: application/json\r\n\r\n" + `{"continuation":"g2gC"}` +
+		"\r\n--b1--\r\n"
+	multipartTerms := "\r\n--b1\r\nContent-Type: application/json\r\n\r\n" + `{"results":[{"t1":"k1"}]}` +
+		"\r\n--b1\r\nContent-Type: application/json\r\n\r\n" + `{"results":[{"t2":"k2"}]}` +
+		"\r\n--b1--\r\n"
+	tests := []struct {
+		name             string
+		contentType      string
+		body             string
+		wantKeys         []string
+		wantContinuation string
+		wantErr          bool
+	}{
+		{"plain", "application/json", `{"keys":["k1","k2"]}`, []string{"k1", "k2"}, "", false},
+		{"no keys", "application/json", `{"keys":[]}`, nil, "", false},
+		{"continuation", "application/json", `{"keys":["k1"],"continuation":"g2gC"}`, []string{"k1"}, "g2gC", false},
+		{"return_terms", "application/json", `{"results":[{"t1":"k1"},{"t2":"k2"}]}`, []string{"k1", "k2"}, "", false},
+		{"multipart", "multipart/mixed; boundary=b1", multipart, []string{"k1", "k2", "k3"}, "g2gC", false},
+		{"multipart return_terms", "multipart/mixed; boundary=b1", multipartTerms, []string{"k1", "k2"}, "", false},
+		{"bad json", "application/json", `{"keys":`, nil, "", true},
+		{"bad multipart", "multipart/mixed; boundary=b1", "\r\n--b1\r\n\r\n{bad}\r\n--b1--\r\n", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, continuation, err := parse2iResponse(tt.contentType, []byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse2iResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(keys, tt.wantKeys) || continuation != tt.wantContinuation {
+				t.Errorf("parse2iResponse() = %q, %q, want %q, %q", keys, continuation, tt.wantKeys, tt.wantContinuation)
+			}
+		})
+	}
+}
+
+func TestSecondaryIndexBackfillPages(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxPages int
+		copied   int // k1..k4 are on pages of 2, 1 and 1 keys
+	}{
+		{"all pages", 0, 4},
+		{"page limit", 2, 3},
+		{"first page", 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := newFakeStore(map[string]string{
+				"/buckets/b/keys/k1": "v1", "/buckets/b/keys/k2": "v2", "/buckets/b/keys/k3": "v3", "/buckets/b/keys/k4": "v4",
+			})
+			donor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/buckets/b/index/f_bin/v" {
+					objects.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Query().Get("continuation") {
+				case "c1":
+					io.WriteString(w, `{"keys":["k3"],"continuation":"c2"}`)
+				case "c2":
+					io.WriteString(w, `{"keys":["k4"]}`)
+				default:
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			})
+			opts := newSettings()
+			opts.riak2iMaxPages = tt.maxPages
+			mode := riakMode{opts: opts}
+			target := newFakeStore(nil)
+			targetInstance, donors := startTestUpstreams(t, mode, target, donor, nil)
+			donorInstance, _ := donors.Next()
+
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}}
+			r := httptest.NewRequest("GET", "/buckets/b/index/f_bin/v?max_results=2", nil)
+			body := []byte(`{"keys":["k1","k2"],"continuation":"c1"}`)
+			if err := storeSecondaryIndexeResponse(mode, opts, donorInstance, targetInstance, resp, r, body); err != nil {
+				t.Fatal(err)
+			}
+			for i, key := range []string{"k1", "k2", "k3", "k4"} {
+				if _, copied := target.get("/buckets/b/keys/" + key); copied != (i < tt.copied) {
+					t.Errorf("key %s copied %v, want %v", key, copied, i < tt.copied)
+				}
+			}
+		})
+	}
+}
+
+func TestRiakURLCoders(t *testing.T) {
+	tests := []struct {
+		name    string
+		space   string
+		path    string
+		encoded string
+	}{
+		{"bucket key", "dev_", "/buckets/b/keys/k", "/buckets/dev_b/keys/k"},
+		{"typed bucket key", "dev_", "/types/t/buckets/b/keys/k", "/types/t/buckets/dev_b/keys/k"},
+		{"old api", "dev_", "/riak/b/k", "/riak/dev_b/k"},
+		{"2i", "dev_", "/types/t/buckets/b/index/f_bin/v", "/types/t/buckets/dev_b/index/f_bin/v"},
+		{"no bucket", "dev_", "/ping", "/ping"},
+		{"no vspace", "", "/types/t/buckets/b/keys/k", "/types/t/buckets/b/keys/k"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := riakURLEncoder(tt.space)(tt.path); got != tt.encoded {
+				t.Errorf("riakURLEncoder(%q)(%q) = %q, want %q", tt.space, tt.path, got, tt.encoded)
+			}
+			if got := riakURLDecoder(tt.space)(tt.encoded); got != tt.path {
+				t.Errorf("riakURLDecoder(%q)(%q) = %q, want %q", tt.space, tt.encoded, got, tt.path)
+			}
+		})
+	}
+}
+
+func TestRiakHeaderCoders(t *testing.T) {
+	tests := []struct {
+		name    string
+		link    string
+		encoded string
+	}{
+		{"bucket", `</buckets/b>; rel="up"`, `</buckets/dev_b>; rel="up"`},
+		{"typed bucket", `</types/t/buckets/b>; rel="up"`, `</types/t/buckets/dev_b>; rel="up"`},
+		{"key link", `</buckets/b/keys/k2>; riaktag="friend"`, `</buckets/dev_b/keys/k2>; riaktag="friend"`},
+		{"typed key link", `</types/t/buckets/b/keys/k2>; riaktag="friend"`, `</types/t/buckets/dev_b/keys/k2>; riaktag="friend"`},
+		{"old api", `</riak/b>; rel="up", </riak/b/k2>; riaktag="friend"`, `</riak/dev_b>; rel="up", </riak/dev_b/k2>; riaktag="friend"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"Link": {tt.link}, "X-Riak-Vclock": {"a85hYGBg"}}
+			encoded := riakHeaderEncoder("dev_")(headers)
+			if got := encoded.Get("Link"); got != tt.encoded {
+				t.Errorf("encoded Link = %q, want %q", got, tt.encoded)
+			}
+			if got := encoded.Get("X-Riak-Vclock"); got != "a85hYGBg" {
+				t.Errorf("encoder changed X-Riak-Vclock to %q", got)
+			}
+			if got := riakHeaderDecoder("dev_")(encoded).Get("Link"); got != tt.link {
+				t.Errorf("decoded Link = %q, want %q", got, tt.link)
+			}
+			if headers.Get("Link") != tt.link {
+				t.Error("encoder changed the source headers")
+			}
+		})
+	}
+}
+
+func TestIsNeedProxyPassRiak(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		body     string
+		want     bool
+		wantRead bool // the body is read only for 2i results
+	}{
+		{"object hit", "/buckets/b/keys/k", http.StatusOK, "hello", false, false},
+		{"object miss", "/buckets/b/keys/k", http.StatusNotFound, "", true, false},
+		{"2i keys", "/buckets/b/index/f_bin/v", http.StatusOK, `{"keys":["k"]}`, false, true},
+		{"2i empty", "/buckets/b/index/f_bin/v", http.StatusOK, `{"keys":[]}`, true, true},
+		{"typed 2i empty", "/types/t/buckets/b/index/f_bin/v", http.StatusOK, `{"keys":[]}`, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			read := false
+			body := func() ([]byte, error) {
+				read = true
+				return []byte(tt.body), nil
+			}
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{"Content-Type": {"application/json"}}}
+			got := isNeedProxyPassRiak(resp, httptest.NewRequest("GET", tt.path, nil), body)
+			if got != tt.want || read != tt.wantRead {
+				t.Errorf("got %v with body read %v, want %v with body read %v", got, read, tt.want, tt.wantRead)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/kzub/trickyproxy/endpoint"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// in-flight donor fetches, concurrent misses for the same key wait for the first one
+var donorFlights = newFlightGroup("request")
+var keyFlights = newFlightGroup("2i_key")
+
+// flight is a donor fetch shared by the leader request and its followers
+type flight struct {
+	done chan struct{}
+	refs int32
+
+	// filled by the leader before done is closed
+	ok     bool
+	status int
+	header http.Header
+	body   *spoolBuffer
+	err    error
+}
+
+type flightGroup struct {
+	name    string
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup(name string) *flightGroup {
+	return &flightGroup{
+		name:    name,
+		flights: make(map[string]*flight),
+	}
+}
+
+// flightHeaders change the donor response, requests which differ in them are not coalesced
+var flightHeaders = []string{"Accept", "Accept-Encoding", "Range"}
+
+func flightKey(target *endpoint.Instance, r *http.Request) string {
+	key := r.Method + " " + target.Name() + target.EncodePath(getPathFromURL(r.URL))
+	if r.URL.RawQuery != "" {
+		key += "?" + r.URL.RawQuery
+	}
+	for _, name := range flightHeaders {
+		if value := r.Header.Get(name); value != "" {
+			key += "\n" + name + ": " + value
+		}
+	}
+	return key
+}
+
+// join returns the flight for key, leader is true if caller must do the fetch and call finish
+func (g *flightGroup) join(key string) (f *flight, leader bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		atomic.AddInt32(&f.refs, 1)
+		coalescedTotal.WithLabelValues(g.name).Inc()
+		return f, false
+	}
+	f = &flight{done: make(chan struct{}), refs: 1}
+	g.flights[key] = f
+	return f, true
+}
+
+// finish wakes up followers, new requests for the key start a new flight
+func (g *flightGroup) finish(key string, f *flight) {
+	g.mutex.Lock()
+	delete(g.flights, key)
+	g.mutex.Unlock()
+	close(f.done)
+}
+
+// share makes response available to followers, spool is closed by the last release
+func (f *flight) share(status int, header http.Header, body *spoolBuffer) {
+	f.ok = true
+	f.status = status
+	f.header = header
+	f.body = body
+}
+
+// release must be called by the leader and every follower
+func (f *flight) release() {
+	if atomic.AddInt32(&f.refs, -1) == 0 && f.body != nil {
+		f.body.Close()
+	}
+}
+
+// serveFollower writes leader's response to the client, false if leader failed and caller must fetch by itself
+func serveFollower(f *flight, w http.ResponseWriter, r *http.Request) (bool, proxyOutcome) {
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		return true, outcomeClientGone
+	}
+
+	if !f.ok {
+		return false, outcomeDonorFail
+	}
+
+	body, err := f.body.Open()
+	if err != nil {
+		logError("COALESCED_OPEN", r, err)
+		return false, outcomeDonorFail
+	}
+	defer body.Close()
+
+	headers := w.Header()
+	for k, v := range f.header {
+		headers[k] = v
+	}
+	w.WriteHeader(f.status)
+	io.Copy(w, body)
+
+	if f.status != http.StatusOK {
+		return true, outcomeDonorMiss
+	}
+	return true, outcomeDonorFill
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"github.com/kzub/trickyproxy/endpoint"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeFollower(t *testing.T) {
+	group := newFlightGroup("test")
+	f, leader := group.join("GET /x/k1")
+	if !leader {
+		t.Fatal("first join must lead")
+	}
+	follower, leader := group.join("GET /x/k1")
+	if leader || follower != f {
+		t.Fatal("second join must follow the first flight")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/x/k1", nil).WithContext(ctx)
+	if served, outcome := serveFollower(f, httptest.NewRecorder(), r); !served || outcome != outcomeClientGone {
+		t.Errorf("gone client got (%v, %s), want (true, %s)", served, outcome, outcomeClientGone)
+	}
+
+	spool := newSpoolBuffer(1<<20, "")
+	spool.Write([]byte("hello"))
+	f.share(http.StatusOK, http.Header{"Content-Type": []string{"text/plain"}}, spool)
+	group.finish("GET /x/k1", f)
+	w := httptest.NewRecorder()
+	served, outcome := serveFollower(f, w, httptest.NewRequest("GET", "/x/k1", nil))
+	if !served || outcome != outcomeDonorFill || w.Body.String() != "hello" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("follower got (%v, %s) %q, want the shared response", served, outcome, w.Body.String())
+	}
+	f.release()
+	f.release()
+}
+
+func TestFlightKey(t *testing.T) {
+	target := endpoint.New("127.0.0.1", "8098", "http", "", nil, nil, nil)
+	key := func(method, path string, header ...string) string {
+		r := httptest.NewRequest(method, path, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return flightKey(target, r)
+	}
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"same request", key("GET", "/x/k1"), key("GET", "/x/k1"), true},
+		{"other header", key("GET", "/x/k1", "User-Agent", "a"), key("GET", "/x/k1", "User-Agent", "b"), true},
+		{"method", key("GET", "/x/k1"), key("HEAD", "/x/k1"), false},
+		{"query", key("GET", "/x/k1?r=1"), key("GET", "/x/k1?r=2"), false},
+		{"accept", key("GET", "/x/k1", "Accept", "multipart/mixed"), key("GET", "/x/k1"), false},
+		{"accept-encoding", key("GET", "/x/k1", "Accept-Encoding", "gzip"), key("GET", "/x/k1"), false},
+		{"range", key("GET", "/x/k1", "Range", "bytes=0-1"), key("GET", "/x/k1", "Range", "bytes=2-3"), false},
+	}
+	for _, tt := range tests {
+		if same := tt.a == tt.b; same != tt.same {
+			t.Errorf("%s: same key %v, want %v", tt.name, same, tt.same)
+		}
+	}
+}
+
+func TestCoalesceDonorFetch(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		values    []string // of the header in concurrent requests
+		wantCalls int32
+	}{
+		{"same key", "", []string{"", "", ""}, 1},
+		{"accept", "Accept", []string{"application/json", "application/json", "multipart/mixed"}, 2},
+		{"range", "Range", []string{"bytes=0-1", "bytes=2-3", "bytes=0-1"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			release := make(chan struct{})
+			donor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				io.WriteString(w, "hello")
+			})
+			proxy := startTestProxy(t, "http", newSettings(), newFakeStore(nil), donor, RulesConfig{})
+			coalesced := testutil.ToFloat64(coalescedTotal.WithLabelValues("request"))
+
+			results := make(chan string, len(tt.values))
+			for _, value := range tt.values {
+				go func(value string) {
+					rq, _ := http.NewRequest("GET", proxy.URL+"/x/k1", nil)
+					if value != "" {
+						rq.Header.Set(tt.header, value)
+					}
+					resp, err := http.DefaultClient.Do(rq)
+					if err != nil {
+						results <- err.Error()
+						return
+					}
+					body, _ := ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+					results <- string(body)
+				}(value)
+			}
+
+			// leaders are at the donor and followers wait for them
+			wantFollowers := float64(len(tt.values)) - float64(tt.wantCalls)
+			for start := time.Now(); atomic.LoadInt32(&calls) < tt.wantCalls ||
+				testutil.ToFloat64(coalescedTotal.WithLabelValues("request"))-coalesced < wantFollowers; {
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("donor got %d requests, want %d", atomic.LoadInt32(&calls), tt.wantCalls)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			close(release)
+
+			for range tt.values {
+				if body := <-results; body != "hello" {
+					t.Errorf("client got %q, want hello", body)
+				}
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("donor got %d requests, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
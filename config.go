@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kzub/trickyproxy/endpoint"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the whole proxy configuration, see config.example.yaml
+type Config struct {
+	Listeners ListenersConfig `yaml:"listeners"`
+	Target    TargetConfig    `yaml:"target"`
+	Donors    []DonorConfig   `yaml:"donors"`
+	Health    HealthConfig    `yaml:"health"`
+	Retry     RetryConfig     `yaml:"retry"`
+	Rules     RulesConfig     `yaml:"rules"`
+}
+
+// ListenersConfig addresses to listen on
+type ListenersConfig struct {
+	Proxy string `yaml:"proxy"`
+}
+
+// TargetConfig the endpoint where fetched data is stored
+type TargetConfig struct {
+	Host      string          `yaml:"host"`
+	Port      string          `yaml:"port"`
+	VSpace    string          `yaml:"vspace"`
+	Timeout   time.Duration   `yaml:"timeout"`
+	Transport TransportConfig `yaml:"transport"`
+	Retry     RetryConfig     `yaml:"retry"`
+}
+
+// DonorConfig the endpoint where missing data is fetched from
+type DonorConfig struct {
+	URL       string          `yaml:"url"`
+	Auth      string          `yaml:"auth"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Weight    int             `yaml:"weight"`
+	Timeout   time.Duration   `yaml:"timeout"`
+	Transport TransportConfig `yaml:"transport"`
+	Retry     RetryConfig     `yaml:"retry"`
+}
+
+// TLSConfig client certificate for https donors
+type TLSConfig struct {
+	Cert   string `yaml:"cert"`
+	Key    string `yaml:"key"`
+	Verify bool   `yaml:"verify"`
+}
+
+// HealthConfig donor health probes and circuit breaker
+type HealthConfig struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Failures int           `yaml:"failures"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// TransportConfig connection timeouts and pool of an endpoint, unset fields take defaults
+type TransportConfig struct {
+	DialTimeout      time.Duration `yaml:"dialtimeout"`
+	TLSTimeout       time.Duration `yaml:"tlstimeout"`
+	HeaderTimeout    time.Duration `yaml:"headertimeout"`
+	BodyTimeout      time.Duration `yaml:"bodytimeout"`
+	IdleConns        int           `yaml:"idleconns"`
+	IdleConnsPerHost int           `yaml:"idleconnsperhost"`
+	MaxConnsPerHost  int           `yaml:"maxconnsperhost"`
+	IdleTimeout      time.Duration `yaml:"idletimeout"`
+	KeepAlive        time.Duration `yaml:"keepalive"`
+}
+
+func (tc *TransportConfig) setDefaults() {
+	def := endpoint.DefaultTransportConfig
+	if tc.DialTimeout == 0 {
+		tc.DialTimeout = def.DialTimeout
+	}
+	if tc.TLSTimeout == 0 {
+		tc.TLSTimeout = def.TLSTimeout
+	}
+	if tc.IdleConns == 0 {
+		tc.IdleConns = def.IdleConns
+	}
+	if tc.IdleConnsPerHost == 0 {
+		tc.IdleConnsPerHost = def.IdleConnsPerHost
+	}
+	if tc.IdleTimeout == 0 {
+		tc.IdleTimeout = def.IdleTimeout
+	}
+	if tc.KeepAlive == 0 {
+		tc.KeepAlive = def.KeepAlive
+	}
+}
+
+// validate checks transport of an endpoint with the given total timeout, zero for the default one
+func (tc TransportConfig) validate(path string, timeout time.Duration, report func(path string, format string, args ...interface{})) {
+	if timeout == 0 {
+		timeout = endpoint.DefaultTimeout
+	}
+	if tc.DialTimeout < 0 {
+		report(path+".dialtimeout", "must not be negative")
+	}
+	if tc.TLSTimeout < 0 {
+		report(path+".tlstimeout", "must not be negative")
+	}
+	if tc.HeaderTimeout < 0 {
+		report(path+".headertimeout", "must not be negative")
+	}
+	if tc.BodyTimeout < 0 {
+		report(path+".bodytimeout", "must not be negative")
+	}
+	if tc.IdleTimeout < 0 {
+		report(path+".idletimeout", "must not be negative")
+	}
+	if tc.HeaderTimeout > timeout {
+		report(path+".headertimeout", "%s is over the total timeout %s", tc.HeaderTimeout, timeout)
+	}
+	if tc.BodyTimeout > timeout {
+		report(path+".bodytimeout", "%s is over the total timeout %s", tc.BodyTimeout, timeout)
+	}
+	if tc.IdleConns < 0 {
+		report(path+".idleconns", "must not be negative")
+	}
+	if tc.IdleConnsPerHost < 0 || tc.IdleConnsPerHost > tc.IdleConns {
+		report(path+".idleconnsperhost", "must be in 0..idleconns")
+	}
+	if tc.MaxConnsPerHost < 0 {
+		report(path+".maxconnsperhost", "must not be negative")
+	}
+}
+
+// RetryConfig upstream retry policy, unset fields of target and donors come from the top level section
+type RetryConfig struct {
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"maxbackoff"`
+	Jitter     float64       `yaml:"jitter"`
+	Deadline   time.Duration `yaml:"deadline"`
+	Methods    []string      `yaml:"methods"`
+	Statuses   []int         `yaml:"statuses"`
+	Budget     float64       `yaml:"budget"`
+}
+
+// inherit fills unset fields from parent
+func (rc *RetryConfig) inherit(parent RetryConfig) {
+	if rc.Attempts == 0 {
+		rc.Attempts = parent.Attempts
+	}
+	if rc.Backoff == 0 {
+		rc.Backoff = parent.Backoff
+	}
+	if rc.MaxBackoff == 0 {
+		rc.MaxBackoff = parent.MaxBackoff
+	}
+	if rc.Jitter == 0 {
+		rc.Jitter = parent.Jitter
+	}
+	if rc.Deadline == 0 {
+		rc.Deadline = parent.Deadline
+	}
+	if rc.Methods == nil {
+		rc.Methods = parent.Methods
+	}
+	if rc.Statuses == nil {
+		rc.Statuses = parent.Statuses
+	}
+	if rc.Budget == 0 {
+		rc.Budget = parent.Budget
+	}
+}
+
+// validate checks settings given in the section, zero values are not set
+func (rc RetryConfig) validate(path string, report func(path string, format string, args ...interface{})) {
+	if rc.Attempts < 0 {
+		report(path+".attempts", "must not be negative")
+	}
+	if rc.Backoff < 0 {
+		report(path+".backoff", "must not be negative")
+	}
+	if rc.MaxBackoff < 0 || (rc.MaxBackoff > 0 && rc.MaxBackoff < rc.Backoff) {
+		report(path+".maxbackoff", "must not be less than backoff")
+	}
+	if rc.Jitter < 0 || rc.Jitter > 1 {
+		report(path+".jitter", "must be in 0..1")
+	}
+	if rc.Deadline < 0 {
+		report(path+".deadline", "must not be negative")
+	}
+	for i, method := range rc.Methods {
+		if method == "" || strings.ToUpper(method) != method {
+			report(path+".methods."+strconv.Itoa(i), "bad method %q, expected upper case name", method)
+		}
+	}
+	for i, status := range rc.Statuses {
+		if status < 100 || status > 599 {
+			report(path+".statuses."+strconv.Itoa(i), "bad status %d", status)
+		}
+	}
+	if rc.Budget < 0 {
+		report(path+".budget", "must not be negative")
+	}
+}
+
+// RulesConfig request path regexp lists
+type RulesConfig struct {
+	NoProxy      []string           `yaml:"noproxy"`
+	StopList     []string           `yaml:"stoplist"`
+	ReadOnlyPost []ReadOnlyPostRule `yaml:"readonlypost"`
+}
+
+// read-only POST donor triggers
+const (
+	// donorOnEmpty asks a donor when the target answers 404 or an empty result
+	donorOnEmpty = "empty"
+	// donorAlways sends requests to a donor without asking the target
+	donorAlways = "always"
+)
+
+// ReadOnlyPostRule POST path regexp allowed to go to donors and its donor trigger, a bare path uses donorOnEmpty
+type ReadOnlyPostRule struct {
+	Path  string `yaml:"path" json:"path"`
+	Donor string `yaml:"donor" json:"donor"`
+}
+
+// UnmarshalYAML reads a bare path regexp or {path, donor}
+func (rule *ReadOnlyPostRule) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		rule.Path = node.Value
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if key := node.Content[i]; key.Value != "path" && key.Value != "donor" {
+			return fmt.Errorf("line %d: field %s not found in readonlypost rule", key.Line, key.Value)
+		}
+	}
+	type plain ReadOnlyPostRule
+	return node.Decode((*plain)(rule))
+}
+
+// parseReadOnlyPostLine reads "regexp [empty | always]" line of readonlypost.conf
+func parseReadOnlyPostLine(line string) ReadOnlyPostRule {
+	if i := strings.LastIndex(line, " "); i > 0 {
+		if donor := line[i+1:]; donor == donorOnEmpty || donor == donorAlways {
+			return ReadOnlyPostRule{Path: cleanString(line[:i]), Donor: donor}
+		}
+	}
+	return ReadOnlyPostRule{Path: line}
+}
+
+// configFlags command line flags pointing to config files
+type configFlags struct {
+	keyfile  *string
+	crtfile  *string
+	dnrfile  *string
+	trgfile  *string
+	srvfile  *string
+	excfile  *string
+	stopfile *string
+	postfile *string
+	cfgfile  *string
+}
+
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	return &configFlags{
+		keyfile:  flags.String("key", "certs/service.key", "service private key"),
+		crtfile:  flags.String("cert", "certs/service.pem", "service public cert"),
+		dnrfile:  flags.String("donors", "donors.conf", "donors hosts list"),
+		trgfile:  flags.String("target", "target.conf", "target host address"),
+		srvfile:  flags.String("srvaddr", "srvaddr.conf", "server host & port to listen"),
+		excfile:  flags.String("noproxy", "noproxy.conf", "request path exceptions list"),
+		stopfile: flags.String("stoplist", "stoplist.conf", "requests stop list"),
+		postfile: flags.String("readonlypost", "readonlypost.conf", "read-only POST path list, allowed to go to donors"),
+		cfgfile:  flags.String("config", "", "yaml config file, replaces donors, target, srvaddr, noproxy, stoplist and readonlypost files"),
+	}
+}
+
+// load reads the yaml config if it is given or the legacy files otherwise
+func (cf *configFlags) load() (*Config, error) {
+	if *cf.cfgfile != "" {
+		return loadConfigFile(*cf.cfgfile, *cf.keyfile, *cf.crtfile)
+	}
+	return loadLegacyConfig(*cf.dnrfile, *cf.trgfile, *cf.srvfile, *cf.excfile, *cf.stopfile, *cf.postfile, *cf.keyfile, *cf.crtfile)
+}
+
+func (cf *configFlags) files() []string {
+	if *cf.cfgfile != "" {
+		return []string{*cf.cfgfile}
+	}
+	return []string{*cf.dnrfile, *cf.trgfile, *cf.srvfile, *cf.excfile, *cf.stopfile, *cf.postfile}
+}
+
+func loadConfigFile(filename, keyfile, crtfile string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.New("CANNOT_READ_CONFIG " + filename)
+	}
+
+	var root yaml.Node
+	if err = yaml.Unmarshal(data, &root); err != nil {
+		return nil, errors.New(filename + ": " + err.Error())
+	}
+
+	cfg := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(cfg); err != nil {
+		return nil, errors.New(filename + ": " + err.Error())
+	}
+
+	cfg.setDefaults(keyfile, crtfile)
+	if err = cfg.validate(filename, &root); err != nil {
+		return nil, err
+	}
+	cfg.inheritRetry()
+	return cfg, nil
+}
+
+// loadLegacyConfig builds Config from donors.conf, target.conf, srvaddr.conf, noproxy.conf, stoplist.conf and readonlypost.conf
+func loadLegacyConfig(dnrfile, trgfile, srvfile, excfile, stopfile, postfile, keyfile, crtfile string) (*Config, error) {
+	cfg := &Config{}
+
+	donorsConfig, err := readConfigFile(dnrfile, true)
+	if err != nil {
+		return nil, errors.New("CANNOT_READ_CONFIG " + dnrfile)
+	}
+	targetConfig, err := readConfigFile(trgfile, true)
+	if err != nil {
+		return nil, errors.New("CANNOT_READ_CONFIG " + trgfile)
+	}
+	serverConfig, err := readConfigFile(srvfile, true)
+	if err != nil {
+		return nil, errors.New("CANNOT_READ_CONFIG " + srvfile)
+	}
+	exceptionsPaths, _ := readConfigFile(excfile, false)
+	stopListPaths, _ := readConfigFile(stopfile, false)
+	readOnlyPostPaths, _ := readConfigFile(postfile, false)
+
+	for _, val := range strings.Split(donorsConfig, "\n") {
+		if len(val) == 0 {
+			continue
+		}
+		data := strings.Split(val, ":")
+
+		protocol := "https"
+		if data[0] == "http" || data[0] == "https" {
+			protocol = data[0]
+			data = data[1:]
+			data[0] = strings.TrimLeft(data[0], "//")
+		}
+		if len(data) < 2 {
+			return nil, errors.New(dnrfile + ": bad donor " + val)
+		}
+
+		donor := DonorConfig{URL: protocol + "://" + data[0] + ":" + cleanString(data[1])}
+		if len(data) > 2 {
+			donor.Auth = cleanString(data[2])
+		}
+		cfg.Donors = append(cfg.Donors, donor)
+	}
+
+	data := strings.Split(targetConfig, ":")
+	if len(data) < 2 {
+		return nil, errors.New(trgfile + ": bad target " + targetConfig)
+	}
+	cfg.Target.Host = data[0]
+	cfg.Target.Port = cleanString(data[1])
+	if len(data) > 2 {
+		cfg.Target.VSpace = cleanString(data[2])
+	}
+
+	cfg.Listeners.Proxy = serverConfig
+	cfg.Rules.NoProxy = splitLines(exceptionsPaths)
+	cfg.Rules.StopList = splitLines(stopListPaths)
+	for _, line := range splitLines(readOnlyPostPaths) {
+		cfg.Rules.ReadOnlyPost = append(cfg.Rules.ReadOnlyPost, parseReadOnlyPostLine(line))
+	}
+
+	cfg.setDefaults(keyfile, crtfile)
+	if err = cfg.validate("legacy config", nil); err != nil {
+		return nil, err
+	}
+	cfg.inheritRetry()
+	return cfg, nil
+}
+
+func splitLines(text string) (lines []string) {
+	for _, line := range strings.Split(text, "\n") {
+		if line = cleanString(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (cfg *Config) setDefaults(keyfile, crtfile string) {
+	health := endpoint.DefaultHealthConfig
+	if cfg.Health.Path == "" {
+		cfg.Health.Path = health.Path
+	}
+	if cfg.Health.Interval == 0 {
+		cfg.Health.Interval = health.Interval
+	}
+	if cfg.Health.Timeout == 0 {
+		cfg.Health.Timeout = health.Timeout
+	}
+	if cfg.Health.Failures == 0 {
+		cfg.Health.Failures = health.Failures
+	}
+	if cfg.Health.Cooldown == 0 {
+		cfg.Health.Cooldown = health.Cooldown
+	}
+	cfg.Retry.inherit(RetryConfig(endpoint.DefaultRetryPolicy))
+	for i := range cfg.Rules.ReadOnlyPost {
+		if cfg.Rules.ReadOnlyPost[i].Donor == "" {
+			cfg.Rules.ReadOnlyPost[i].Donor = donorOnEmpty
+		}
+	}
+	cfg.Target.Transport.setDefaults()
+	for i := range cfg.Donors {
+		donor := &cfg.Donors[i]
+		donor.Transport.setDefaults()
+		if donor.Weight == 0 {
+			donor.Weight = 1
+		}
+		if donor.TLS.Cert == "" && donor.TLS.Key == "" {
+			donor.TLS.Cert = crtfile
+			donor.TLS.Key = keyfile
+		}
+	}
+}
+
+// inheritRetry gives target and donors the top level retry settings they do not override
+func (cfg *Config) inheritRetry() {
+	cfg.Target.Retry.inherit(cfg.Retry)
+	for i := range cfg.Donors {
+		cfg.Donors[i].Retry.inherit(cfg.Retry)
+	}
+}
+
+// validate collects all config errors, root is used to find line numbers
+func (cfg *Config) validate(filename string, root *yaml.Node) error {
+	var errs []string
+	report := func(path string, format string, args ...interface{}) {
+		location := filename
+		if line := nodeLine(root, path); line > 0 {
+			location += ":" + strconv.Itoa(line)
+		}
+		errs = append(errs, location+": "+path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if cfg.Listeners.Proxy == "" {
+		report("listeners.proxy", "address is required")
+	}
+
+	if cfg.Target.Host == "" {
+		report("target.host", "host is required")
+	}
+	if !validPort(cfg.Target.Port) {
+		report("target.port", "bad port %q", cfg.Target.Port)
+	}
+	if cfg.Target.Timeout < 0 {
+		report("target.timeout", "must not be negative")
+	}
+	cfg.Target.Transport.validate("target.transport", cfg.Target.Timeout, report)
+	cfg.Target.Retry.validate("target.retry", report)
+
+	if len(cfg.Donors) == 0 {
+		report("donors", "at least one donor is required")
+	}
+	for i, donor := range cfg.Donors {
+		path := "donors." + strconv.Itoa(i)
+		u, err := url.Parse(donor.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			report(path+".url", "bad url %q, expected http(s)://host:port", donor.URL)
+		} else if !validPort(u.Port()) {
+			report(path+".url", "bad port in url %q", donor.URL)
+		}
+		if donor.Weight < 0 {
+			report(path+".weight", "must not be negative")
+		}
+		if donor.Timeout < 0 {
+			report(path+".timeout", "must not be negative")
+		}
+		donor.Transport.validate(path+".transport", donor.Timeout, report)
+		donor.Retry.validate(path+".retry", report)
+		if (donor.TLS.Cert == "") != (donor.TLS.Key == "") {
+			report(path+".tls", "cert and key must be set together")
+		}
+	}
+
+	if !strings.HasPrefix(cfg.Health.Path, "/") {
+		report("health.path", "must start with /")
+	}
+	if cfg.Health.Interval < 0 {
+		report("health.interval", "must not be negative")
+	}
+	if cfg.Health.Timeout < 0 {
+		report("health.timeout", "must not be negative")
+	}
+	if cfg.Health.Failures < 0 {
+		report("health.failures", "must not be negative")
+	}
+	if cfg.Health.Cooldown < 0 {
+		report("health.cooldown", "must not be negative")
+	}
+	cfg.Retry.validate("retry", report)
+
+	for i, expr := range cfg.Rules.NoProxy {
+		if _, err := regexp.Compile(expr); err != nil {
+			report("rules.noproxy."+strconv.Itoa(i), "bad regexp %q", expr)
+		}
+	}
+	for i, expr := range cfg.Rules.StopList {
+		if _, err := regexp.Compile(expr); err != nil {
+			report("rules.stoplist."+strconv.Itoa(i), "bad regexp %q", expr)
+		}
+	}
+	for i, rule := range cfg.Rules.ReadOnlyPost {
+		path := "rules.readonlypost." + strconv.Itoa(i)
+		if _, err := regexp.Compile(rule.Path); err != nil || rule.Path == "" {
+			report(path+".path", "bad regexp %q", rule.Path)
+		}
+		if rule.Donor != donorOnEmpty && rule.Donor != donorAlways {
+			report(path+".donor", "bad donor trigger %q, expected %s or %s", rule.Donor, donorOnEmpty, donorAlways)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("BAD_CONFIG\n" + strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// nodeLine returns line of the deepest existing node on the dotted path, 0 if unknown
+func nodeLine(root *yaml.Node, path string) int {
+	if root == nil {
+		return 0
+	}
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					next = node.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			if idx, err := strconv.Atoi(part); err == nil && idx < len(node.Content) {
+				next = node.Content[idx]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
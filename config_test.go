@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/kzub/trickyproxy/endpoint"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyPostRules(t *testing.T) {
+	const base = `
+listeners: {proxy: 127.0.0.1:8036}
+target: {host: 127.0.0.1, port: "8098"}
+donors: [{url: "http://127.0.0.1:8099"}]
+rules:
+  readonlypost:
+`
+	tests := []struct {
+		name    string
+		rules   string
+		want    []ReadOnlyPostRule
+		wantErr string
+	}{
+		{
+			name:  "bare path and rule",
+			rules: "    - ^/mapred\n    - {path: ^/search/query/, donor: always}\n",
+			want:  []ReadOnlyPostRule{{Path: "^/mapred", Donor: donorOnEmpty}, {Path: "^/search/query/", Donor: donorAlways}},
+		},
+		{
+			name:    "bad trigger",
+			rules:   "    - {path: ^/mapred, donor: 404}\n",
+			wantErr: `:7: rules.readonlypost.0.donor: bad donor trigger "404"`,
+		},
+		{
+			name:    "unknown field",
+			rules:   "    - {path: ^/mapred, when: always}\n",
+			wantErr: "field when not found",
+		},
+		{
+			name:    "bad regexp",
+			rules:   "    - {path: \"^/mapred(\"}\n",
+			wantErr: "rules.readonlypost.0.path: bad regexp",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.yaml")
+			if err := ioutil.WriteFile(filename, []byte(base+tt.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadConfigFile(filename, "", "")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg.Rules.ReadOnlyPost, tt.want) {
+				t.Errorf("got %+v, want %+v", cfg.Rules.ReadOnlyPost, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReadOnlyPostLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want ReadOnlyPostRule
+	}{
+		{`^/mapred(\?|$)`, ReadOnlyPostRule{Path: `^/mapred(\?|$)`}},
+		{`^/search/query/ always`, ReadOnlyPostRule{Path: `^/search/query/`, Donor: donorAlways}},
+		{`^/mapred  empty`, ReadOnlyPostRule{Path: `^/mapred`, Donor: donorOnEmpty}},
+		{`^/a b`, ReadOnlyPostRule{Path: `^/a b`}},
+	}
+	for _, tt := range tests {
+		if got := parseReadOnlyPostLine(tt.line); got != tt.want {
+			t.Errorf("parseReadOnlyPostLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestTransportConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(tc *TransportConfig)
+		timeout time.Duration
+		want    []string
+	}{
+		{"defaults", func(tc *TransportConfig) {}, 0, nil},
+		{"header timeout over total", func(tc *TransportConfig) { tc.HeaderTimeout = 5 * time.Second }, 0, []string{"t.headertimeout"}},
+		{"header timeout within total", func(tc *TransportConfig) { tc.HeaderTimeout = 5 * time.Second }, 10 * time.Second, nil},
+		{"body timeout over total", func(tc *TransportConfig) { tc.BodyTimeout = 2 * time.Second }, time.Second, []string{"t.bodytimeout"}},
+		{"negative timeout", func(tc *TransportConfig) { tc.DialTimeout = -1 }, 0, []string{"t.dialtimeout"}},
+		{"idleconnsperhost over idleconns", func(tc *TransportConfig) { tc.IdleConnsPerHost = tc.IdleConns + 1 }, 0, []string{"t.idleconnsperhost"}},
+		{"negative idleconns", func(tc *TransportConfig) { tc.IdleConns, tc.IdleConnsPerHost = -1, 0 }, 0, []string{"t.idleconns", "t.idleconnsperhost"}},
+		{"negative maxconnsperhost", func(tc *TransportConfig) { tc.MaxConnsPerHost = -1 }, 0, []string{"t.maxconnsperhost"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := TransportConfig(endpoint.DefaultTransportConfig)
+			tt.change(&tc)
+			var got []string
+			tc.validate("t", tt.timeout, func(path string, format string, args ...interface{}) {
+				got = append(got, path)
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got errors of %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
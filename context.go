@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// detachedContext keeps values of the parent (trace span, retry deadline, access record) but is never cancelled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+// detach is for work that must be finished after the client request is gone
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+// fillContext is cancelled with parent until keep is called, after that only by cancel.
+// A donor fetch stops when the client goes away, but a donor answer is stored anyway
+func fillContext(parent context.Context) (ctx context.Context, keep func(), cancel context.CancelFunc) {
+	ctx, cancel = context.WithCancel(detach(parent))
+	var mutex sync.Mutex
+	kept := false
+	go func() {
+		select {
+		case <-parent.Done():
+			mutex.Lock()
+			if !kept {
+				cancel()
+			}
+			mutex.Unlock()
+		case <-ctx.Done():
+		}
+	}()
+	keep = func() {
+		mutex.Lock()
+		kept = true
+		mutex.Unlock()
+	}
+	return ctx, keep, cancel
+}
@@ -2,13 +2,21 @@ package endpoint
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,9 +28,27 @@ type URLModifier func(text string) string
 // HeaderModifier replace urls inside headers (if the are exists)
 type HeaderModifier func(h http.Header) http.Header
 
+// tracer makes client spans of upstream requests whose caller is traced
+var tracer = otel.Tracer("github.com/kzub/trickyproxy/endpoint")
+
+func endSpan(span trace.Span, resp *http.Response, err error) {
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
 // Instance connection client
 type Instance struct {
+	requests      int64 // atomic, first for 64-bit alignment
+	errors        int64 // atomic
+	disabled      int32 // atomic, disabled instance gets no requests from Instances.Next
 	readonly      bool
+	readOnlyPost  func(rURL *url.URL) bool
 	protocol      string
 	host          string
 	port          string
@@ -31,6 +57,11 @@ type Instance struct {
 	headerEncoder HeaderModifier
 	headerDecoder HeaderModifier
 	client        *http.Client
+	tlsConfig     *tls.Config
+	bodyTimeout   time.Duration
+	breaker       *breaker
+	retry         RetryPolicy
+	budget        *retryBudget
 }
 
 // New make new enfpoint
@@ -39,7 +70,7 @@ func New(host, port, protocol, auth string, urlEncoder URLModifier, headerEncode
 		log.Fatal("bad protocol", protocol)
 	}
 
-	return &Instance{
+	inst := &Instance{
 		readonly:      false,
 		protocol:      protocol,
 		host:          host,
@@ -48,17 +79,22 @@ func New(host, port, protocol, auth string, urlEncoder URLModifier, headerEncode
 		urlEncoder:    urlEncoder,
 		headerEncoder: headerEncoder,
 		headerDecoder: headerDecoder,
+		retry:         DefaultRetryPolicy,
+		budget:        &retryBudget{ratio: DefaultRetryPolicy.Budget},
 		client: &http.Client{
-			Timeout: time.Second * 4,
-			Transport: &http.Transport{
-				DisableCompression: true, // without this decompress plain data by default.
-			},
+			Timeout: DefaultTimeout,
 		},
 	}
+	return inst.SetTransport(DefaultTransportConfig)
 }
 
 // NewTLS make new tls Instance
 func NewTLS(protocol, host, port, auth, keyfile, crtfile string) *Instance {
+	return NewTLSConfig(protocol, host, port, auth, keyfile, crtfile, false)
+}
+
+// NewTLSConfig make new tls Instance, server certificate is checked only when verify is set
+func NewTLSConfig(protocol, host, port, auth, keyfile, crtfile string, verify bool) *Instance {
 	cert, err := tls.LoadX509KeyPair(crtfile, keyfile)
 	if err != nil {
 		zap.L().Error("no certificates loaded",
@@ -67,14 +103,26 @@ func NewTLS(protocol, host, port, auth, keyfile, crtfile string) *Instance {
 	}
 	config := &tls.Config{
 		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
+		InsecureSkipVerify: !verify,
 	}
 	Instance := New(host, port, protocol, auth, nil, nil, nil)
-	Instance.client.Transport = &http.Transport{
-		TLSClientConfig:    config,
-		DisableCompression: true,
+	Instance.tlsConfig = config
+	return Instance.SetTransport(DefaultTransportConfig)
+}
+
+// SetTimeout change total request timeout, zero keeps the default
+func (inst *Instance) SetTimeout(timeout time.Duration) *Instance {
+	if timeout > 0 {
+		inst.client.Timeout = timeout
 	}
-	return Instance
+	return inst
+}
+
+// SetRetryPolicy change how failed requests are repeated
+func (inst *Instance) SetRetryPolicy(policy RetryPolicy) *Instance {
+	inst.retry = policy
+	inst.budget = &retryBudget{ratio: policy.Budget}
+	return inst
 }
 
 // MakeReadOnly make Instance readonly
@@ -83,6 +131,25 @@ func (inst *Instance) MakeReadOnly() *Instance {
 	return inst
 }
 
+// AllowReadOnlyPost lets POST requests matching check through a readonly Instance
+func (inst *Instance) AllowReadOnlyPost(check func(rURL *url.URL) bool) *Instance {
+	inst.readOnlyPost = check
+	return inst
+}
+
+// Name identify Instance in logs and metrics
+func (inst *Instance) Name() string {
+	return inst.host + ":" + inst.port
+}
+
+// EncodePath applies virtual space of the instance to the path
+func (inst *Instance) EncodePath(path string) string {
+	if inst.urlEncoder == nil {
+		return path
+	}
+	return inst.urlEncoder(path)
+}
+
 func getURLText(inst *Instance, method string, u *url.URL) string {
 	text := method + " " + inst.protocol + "://" + inst.host + ":" + inst.port
 	if len(u.RawPath) > 0 {
@@ -131,21 +198,60 @@ func (inst *Instance) getRequest(originalRq *http.Request) *http.Request {
 		header["Authorization"] = append(header["Authorization"], "Basic "+inst.auth)
 	}
 
+	// trace context of the caller goes upstream as W3C traceparent
+	otel.GetTextMapPropagator().Inject(originalRq.Context(), propagation.HeaderCarrier(header))
+
 	zap.L().Info(getURLText(inst, originalRq.Method, newURL))
 
-	return &http.Request{
+	rq := &http.Request{
 		Method:        originalRq.Method,
 		Header:        header,
 		URL:           newURL,
 		Body:          originalRq.Body,
+		GetBody:       originalRq.GetBody,
 		ContentLength: originalRq.ContentLength,
 	}
+	return rq.WithContext(originalRq.Context())
 }
 
 // Get load data from path
 func (inst *Instance) Get(path string) (resp *http.Response, body []byte, err error) {
+	return inst.GetContext(context.Background(), path)
+}
+
+// GetContext is Get cancelled with ctx
+func (inst *Instance) GetContext(ctx context.Context, path string) (resp *http.Response, body []byte, err error) {
 	url, _ := url.Parse(path)
-	return inst.Do(&http.Request{
+	return inst.DoContext(ctx, &http.Request{
+		Method: "GET",
+		URL:    url,
+	})
+}
+
+// Head load headers of path
+func (inst *Instance) Head(path string) (resp *http.Response, err error) {
+	return inst.HeadContext(context.Background(), path)
+}
+
+// HeadContext is Head cancelled with ctx
+func (inst *Instance) HeadContext(ctx context.Context, path string) (resp *http.Response, err error) {
+	url, _ := url.Parse(path)
+	resp, _, err = inst.DoContext(ctx, &http.Request{
+		Method: "HEAD",
+		URL:    url,
+	})
+	return resp, err
+}
+
+// GetStream load data from path, caller must close response body
+func (inst *Instance) GetStream(path string) (resp *http.Response, err error) {
+	return inst.GetStreamContext(context.Background(), path)
+}
+
+// GetStreamContext is GetStream cancelled with ctx, reading the body too
+func (inst *Instance) GetStreamContext(ctx context.Context, path string) (resp *http.Response, err error) {
+	url, _ := url.Parse(path)
+	return inst.DoStreamContext(ctx, &http.Request{
 		Method: "GET",
 		URL:    url,
 	})
@@ -153,8 +259,13 @@ func (inst *Instance) Get(path string) (resp *http.Response, body []byte, err er
 
 // Post something
 func (inst *Instance) Post(path string, headers http.Header, body []byte) (resp *http.Response, body2 []byte, err error) {
+	return inst.PostContext(context.Background(), path, headers, body)
+}
+
+// PostContext is Post cancelled with ctx
+func (inst *Instance) PostContext(ctx context.Context, path string, headers http.Header, body []byte) (resp *http.Response, body2 []byte, err error) {
 	url, _ := url.Parse(path)
-	return inst.Do(&http.Request{
+	return inst.DoContext(ctx, &http.Request{
 		Method:        "POST",
 		Header:        headers,
 		ContentLength: int64(len(body)),
@@ -163,72 +274,236 @@ func (inst *Instance) Post(path string, headers http.Header, body []byte) (resp
 	})
 }
 
-// Do something
+// PostStream post body of given length, getBody is called again for every retry
+func (inst *Instance) PostStream(path string, headers http.Header, length int64, getBody func() (io.ReadCloser, error)) (resp *http.Response, body []byte, err error) {
+	return inst.PostStreamContext(context.Background(), path, headers, length, getBody)
+}
+
+// PostStreamContext is PostStream cancelled with ctx
+func (inst *Instance) PostStreamContext(ctx context.Context, path string, headers http.Header, length int64, getBody func() (io.ReadCloser, error)) (resp *http.Response, body []byte, err error) {
+	return inst.sendStream(ctx, "POST", path, headers, length, getBody)
+}
+
+// PutStream is PostStream with PUT method
+func (inst *Instance) PutStream(path string, headers http.Header, length int64, getBody func() (io.ReadCloser, error)) (resp *http.Response, body []byte, err error) {
+	return inst.PutStreamContext(context.Background(), path, headers, length, getBody)
+}
+
+// PutStreamContext is PutStream cancelled with ctx
+func (inst *Instance) PutStreamContext(ctx context.Context, path string, headers http.Header, length int64, getBody func() (io.ReadCloser, error)) (resp *http.Response, body []byte, err error) {
+	return inst.sendStream(ctx, "PUT", path, headers, length, getBody)
+}
+
+func (inst *Instance) sendStream(ctx context.Context, method, path string, headers http.Header, length int64, getBody func() (io.ReadCloser, error)) (resp *http.Response, body []byte, err error) {
+	url, _ := url.Parse(path)
+	rqBody, err := getBody()
+	if err != nil {
+		return nil, nil, err
+	}
+	return inst.DoContext(ctx, &http.Request{
+		Method:        method,
+		Header:        headers,
+		ContentLength: length,
+		Body:          rqBody,
+		GetBody:       getBody,
+		URL:           url,
+	})
+}
+
+// DoContext is Do cancelled with ctx instead of the context of originalRq
+func (inst *Instance) DoContext(ctx context.Context, originalRq *http.Request) (resp *http.Response, body []byte, err error) {
+	return inst.Do(originalRq.WithContext(ctx))
+}
+
+// DoStreamContext is DoStream cancelled with ctx instead of the context of originalRq
+func (inst *Instance) DoStreamContext(ctx context.Context, originalRq *http.Request) (resp *http.Response, err error) {
+	return inst.DoStream(originalRq.WithContext(ctx))
+}
+
+// Do something, the request is cancelled with the context of originalRq
 func (inst *Instance) Do(originalRq *http.Request) (resp *http.Response, body []byte, err error) {
-	if inst.readonly {
+	resp, err = inst.DoStream(originalRq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// no error here, read body
+	if resp.Body != nil {
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			zap.L().Error("RESP_READ_BODY",
+				zap.String("error", err.Error()),
+			)
+			return nil, nil, err
+		}
+	}
+
+	return resp, body, err
+}
+
+func (inst *Instance) isReadOnlyPost(rq *http.Request) bool {
+	return strings.ToUpper(rq.Method) == "POST" && inst.readOnlyPost != nil && inst.readOnlyPost(rq.URL)
+}
+
+// DoStream something without reading response body, caller must close it.
+// Cancelled context of originalRq stops retries and the body
+func (inst *Instance) DoStream(originalRq *http.Request) (resp *http.Response, err error) {
+	if inst.readonly && !inst.isReadOnlyPost(originalRq) {
 		if strings.ToUpper(originalRq.Method) == "POST" || strings.ToUpper(originalRq.Method) == "PUT" ||
 			strings.ToUpper(originalRq.Method) == "PATCH" || strings.ToUpper(originalRq.Method) == "DELETE" {
 			zap.L().Error("CANNOT WRITE TO READONLY ENDPOINT",
 				zap.String("url", originalRq.URL.String()),
 			)
-			return nil, nil, errors.New("CANNOT WRITE TO READONLY ENDPOINT")
+			return nil, errors.New("CANNOT WRITE TO READONLY ENDPOINT")
 		}
 	}
 
+	if trace.SpanContextFromContext(originalRq.Context()).IsValid() {
+		ctx, span := tracer.Start(originalRq.Context(), originalRq.Method+" "+inst.Name(),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("http.method", originalRq.Method),
+				attribute.String("peer", inst.Name()),
+			),
+		)
+		defer func() { endSpan(span, resp, err) }()
+		originalRq = originalRq.WithContext(ctx)
+	}
+
 	rq := inst.getRequest(originalRq)
-	var rqBodyData []byte
 
-	// make body data copy for retry
-	if rq.Body != nil {
+	// make body data copy for retry, unless caller knows how to reopen it
+	if rq.Body != nil && rq.GetBody == nil {
+		var rqBodyData []byte
 		rqBodyData, err = ioutil.ReadAll(rq.Body)
 		rq.Body.Close()
 		if err != nil {
 			zap.L().Error("RQ_READ_BODY",
 				zap.String("error", err.Error()),
 			)
-			return nil, nil, err
+			return nil, err
 		}
 		rq.Body = ioutil.NopCloser(bytes.NewBuffer(rqBodyData))
+		rq.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewBuffer(rqBodyData)), nil
+		}
 	}
 
+	// body timeout cancels the request after the headers
+	cancelBody := context.CancelFunc(func() {})
+	if inst.bodyTimeout > 0 {
+		var ctx context.Context
+		ctx, cancelBody = context.WithCancel(rq.Context())
+		rq = rq.WithContext(ctx)
+	}
+	defer func() {
+		if err != nil {
+			cancelBody()
+		}
+	}()
+
 	// make a request!
+	policy := inst.retry
+	deadline := policy.retryDeadline(originalRq.Context(), time.Now())
+	retryable := policy.retryMethod(originalRq.Method) || inst.isReadOnlyPost(originalRq)
+	inst.budget.request()
+	inst.countRequest()
 	resp, err = inst.client.Do(rq)
+	inst.record(resp, err)
+
+	for attempt := 1; err != nil || policy.retryStatus(resp.StatusCode); attempt++ {
+		if ctxErr := originalRq.Context().Err(); ctxErr != nil {
+			zap.L().Info("request cancelled",
+				zap.String("request", getURLText(inst, originalRq.Method, rq.URL)),
+			)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctxErr
+		}
+		if err != nil && inst.breaker != nil && inst.breaker.open() {
+			inst.countError()
+			zap.L().Error("DO_FAILED, upstream ejected",
+				zap.String("error", err.Error()),
+				zap.String("request", getURLText(inst, originalRq.Method, rq.URL)),
+			)
+			return nil, ErrInstanceUnavailable
+		}
+
+		var failure string
+		if err != nil {
+			failure = err.Error()
+		} else {
+			failure = "status " + strconv.Itoa(resp.StatusCode)
+		}
+		delay := policy.backoff(attempt)
+		stop := ""
+		switch {
+		case !retryable:
+			stop = "method is not retried"
+		case attempt >= policy.Attempts:
+			stop = "no attempts left"
+		case !deadline.IsZero() && time.Now().Add(delay).After(deadline):
+			stop = "retry deadline"
+		case !inst.budget.allow():
+			stop = "retry budget exhausted"
+		}
+		if stop != "" {
+			if err == nil {
+				break // the caller gets the last response with retryable status
+			}
+			inst.countError()
+			zap.L().Error("DO_FAILED",
+				zap.String("error", failure),
+				zap.String("reason", stop),
+				zap.Int("attempts", attempt),
+				zap.String("request", getURLText(inst, originalRq.Method, rq.URL)),
+			)
+			return nil, err
+		}
 
-	counter := 10
-	for err != nil {
 		zap.L().Error("request error",
-			zap.String("error", err.Error()),
-			zap.Int("retry_left", counter),
+			zap.String("error", failure),
+			zap.Int("retry_left", policy.Attempts-attempt),
+			zap.Duration("delay", delay),
 			zap.String("request", getURLText(inst, originalRq.Method, rq.URL)),
 		)
-		time.Sleep(500 * time.Millisecond)
+		trace.SpanFromContext(originalRq.Context()).AddEvent("retry", trace.WithAttributes(
+			attribute.String("error", failure),
+		))
+		countRetry(originalRq.Context())
+		if resp != nil {
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-originalRq.Context().Done():
+			timer.Stop()
+			return nil, originalRq.Context().Err()
+		}
 
 		// make new reader from stored data
 		if rq.Body != nil {
-			rq.Body = ioutil.NopCloser(bytes.NewBuffer(rqBodyData))
+			rq.Body, err = rq.GetBody()
+			if err != nil {
+				inst.countError()
+				zap.L().Error("RQ_REOPEN_BODY",
+					zap.String("error", err.Error()),
+				)
+				return nil, err
+			}
 		}
 		// make a request again!
+		inst.countRequest()
+		upstreamRetries.WithLabelValues(inst.Name()).Inc()
 		resp, err = inst.client.Do(rq)
-		counter--
-
-		if err != nil && counter == 0 {
-			zap.L().Error("DO_FAILED",
-				zap.String("error", err.Error()),
-			)
-			return nil, nil, err
-		}
+		inst.record(resp, err)
 	}
 
-	// no error here, read body
-	if resp.Body != nil {
-		defer resp.Body.Close()
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			zap.L().Error("RESP_READ_BODY",
-				zap.String("error", err.Error()),
-			)
-			return nil, nil, err
-		}
+	if inst.bodyTimeout > 0 {
+		resp.Body = newTimedBody(resp.Body, inst.bodyTimeout, cancelBody)
 	}
 
 	// modify output headers (remove virtual space prefixes from headers)
@@ -236,40 +511,87 @@ func (inst *Instance) Do(originalRq *http.Request) (resp *http.Response, body []
 		resp.Header = inst.headerDecoder(resp.Header)
 	}
 
-	return resp, body, err
+	return resp, nil
 }
 
 // Instances holds serveral endpoints
 type Instances struct {
 	instances []*Instance
-	counter   int
+	weights   []int
+	current   []int
 	length    int
 	mutex     *sync.Mutex
+	stop      chan struct{}
+	stopOnce  sync.Once
 }
 
 // NewInstances make new instances list
 func NewInstances() *Instances {
 	return &Instances{
 		mutex: &sync.Mutex{},
+		stop:  make(chan struct{}),
 	}
 }
 
 // Add instance to the pool
 func (i *Instances) Add(inst *Instance) {
+	i.AddWeighted(inst, 1)
+}
+
+// AddWeighted add instance to the pool, it gets requests in proportion to its weight
+func (i *Instances) AddWeighted(inst *Instance, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
 	i.mutex.Lock()
 	i.instances = append(i.instances, inst)
+	i.weights = append(i.weights, weight)
+	i.current = append(i.current, 0)
 	i.length++
 	i.mutex.Unlock()
 }
 
-// Next get next endpoint instance
-func (i *Instances) Next() *Instance {
+// Len returns amount of instances in the pool
+func (i *Instances) Len() int {
 	i.mutex.Lock()
-	i.counter++
-	if i.counter >= i.length {
-		i.counter = 0
+	defer i.mutex.Unlock()
+	return i.length
+}
+
+// Next get next healthy endpoint instance (smooth weighted round robin)
+func (i *Instances) Next() (*Instance, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var total, best = 0, -1
+	for idx, weight := range i.weights {
+		inst := i.instances[idx]
+		if !inst.Enabled() || (inst.breaker != nil && !inst.breaker.ready()) {
+			continue
+		}
+		i.current[idx] += weight
+		total += weight
+		if best < 0 || i.current[idx] > i.current[best] {
+			best = idx
+		}
+	}
+	if best < 0 {
+		return nil, ErrNoHealthyInstances
+	}
+
+	i.current[best] -= total
+	inst := i.instances[best]
+	if inst.breaker != nil {
+		inst.breaker.take()
+	}
+	return inst, nil
+}
+
+// CloseIdleConnections drops keep-alive connections of all instances in the pool
+func (i *Instances) CloseIdleConnections() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	for _, inst := range i.instances {
+		inst.client.CloseIdleConnections()
 	}
-	var instanceIdx = i.counter
-	i.mutex.Unlock()
-	return i.instances[instanceIdx]
 }
@@ -0,0 +1,203 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNoHealthyInstances returned by Next when every instance of the pool is ejected
+var ErrNoHealthyInstances = errors.New("NO_HEALTHY_INSTANCES")
+
+// ErrInstanceUnavailable returned by Do when circuit breaker of the instance opens
+var ErrInstanceUnavailable = errors.New("INSTANCE_UNAVAILABLE")
+
+// HealthConfig active health probes and circuit breaker settings
+type HealthConfig struct {
+	Path     string        // probe path, any response below 500 means healthy
+	Interval time.Duration // probe interval, zero disables probes
+	Timeout  time.Duration // probe timeout
+	Failures int           // consecutive failures to eject instance
+	Cooldown time.Duration // time before ejected instance gets a trial request
+}
+
+// DefaultHealthConfig is used when no settings are given
+var DefaultHealthConfig = HealthConfig{
+	Path:     "/ping",
+	Interval: 5 * time.Second,
+	Timeout:  2 * time.Second,
+	Failures: 3,
+	Cooldown: 10 * time.Second,
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker ejects instance after consecutive failures and lets one trial request through every cooldown
+type breaker struct {
+	mutex     sync.Mutex
+	name      string
+	state     breakerState
+	failures  int
+	changed   time.Time
+	threshold int
+	cooldown  time.Duration
+}
+
+func newBreaker(name string, threshold int, cooldown time.Duration) *breaker {
+	upstreamUp.WithLabelValues(name).Set(1)
+	return &breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// ready tells if instance may get a request, does not change the state
+func (b *breaker) ready() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == breakerClosed || time.Since(b.changed) >= b.cooldown
+}
+
+// take marks instance as chosen, ejected instance switches to half-open for a trial request
+func (b *breaker) take() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state != breakerClosed {
+		b.state = breakerHalfOpen
+		b.changed = time.Now()
+	}
+}
+
+func (b *breaker) open() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == breakerOpen
+}
+
+func (b *breaker) healthy() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == breakerClosed
+}
+
+func (b *breaker) stateName() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+func (b *breaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	if b.state != breakerClosed {
+		b.state = breakerClosed
+		b.changed = time.Now()
+		upstreamUp.WithLabelValues(b.name).Set(1)
+		zap.L().Info("upstream is back",
+			zap.String("upstream", b.name),
+		)
+	}
+}
+
+func (b *breaker) failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.changed = time.Now()
+		upstreamUp.WithLabelValues(b.name).Set(0)
+		zap.L().Error("UPSTREAM_EJECTED",
+			zap.String("upstream", b.name),
+			zap.Int("failures", b.failures),
+		)
+	}
+}
+
+// record passes request result to the breaker if instance has one
+func (inst *Instance) record(resp *http.Response, err error) {
+	if inst.breaker == nil || errors.Is(err, context.Canceled) {
+		return // a request cancelled by the caller says nothing about the upstream
+	}
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		inst.breaker.failure()
+		return
+	}
+	inst.breaker.success()
+}
+
+// Healthy tells if circuit breaker of the instance is closed
+func (inst *Instance) Healthy() bool {
+	return inst.breaker == nil || inst.breaker.healthy()
+}
+
+func (inst *Instance) probe(cfg HealthConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	rq, err := http.NewRequestWithContext(ctx, "GET", inst.protocol+"://"+inst.Name()+cfg.Path, nil)
+	if err != nil {
+		inst.record(nil, err)
+		return
+	}
+	if inst.auth != "" {
+		rq.Header.Set("Authorization", "Basic "+inst.auth)
+	}
+
+	resp, err := inst.client.Do(rq)
+	if err == nil {
+		resp.Body.Close()
+	}
+	inst.record(resp, err)
+}
+
+// StartHealthChecks enables circuit breakers and periodic probes for every instance of the pool
+func (i *Instances) StartHealthChecks(cfg HealthConfig) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	for _, inst := range i.instances {
+		inst.breaker = newBreaker(inst.Name(), cfg.Failures, cfg.Cooldown)
+		if cfg.Interval > 0 {
+			go i.probeLoop(inst, cfg)
+		}
+	}
+}
+
+func (i *Instances) probeLoop(inst *Instance, cfg HealthConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.stop:
+			return
+		case <-ticker.C:
+			inst.probe(cfg)
+		}
+	}
+}
+
+// Close stops health probes and drops idle connections, the pool must not be used after that
+func (i *Instances) Close() {
+	i.stopOnce.Do(func() {
+		close(i.stop)
+	})
+	i.CloseIdleConnections()
+}
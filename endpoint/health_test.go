@@ -0,0 +1,142 @@
+package endpoint
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	type step struct {
+		op        string // success, failure, take or wait for the cooldown
+		wantState string
+		wantReady bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"opens after threshold", []step{
+			{"failure", "closed", true},
+			{"failure", "open", false},
+		}},
+		{"success resets failures", []step{
+			{"failure", "closed", true},
+			{"success", "closed", true},
+			{"failure", "closed", true},
+		}},
+		{"trial after cooldown", []step{
+			{"failure", "closed", true},
+			{"failure", "open", false},
+			{"wait", "open", true},
+			{"take", "half-open", false},
+			{"success", "closed", true},
+		}},
+		{"failed trial", []step{
+			{"failure", "closed", true},
+			{"failure", "open", false},
+			{"wait", "open", true},
+			{"take", "half-open", false},
+			{"failure", "open", false},
+			{"wait", "open", true},
+		}},
+		{"one trial per cooldown", []step{
+			{"failure", "closed", true},
+			{"failure", "open", false},
+			{"wait", "open", true},
+			{"take", "half-open", false},
+			{"wait", "half-open", true},
+			{"take", "half-open", false},
+		}},
+		{"take on closed", []step{
+			{"take", "closed", true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker("test", 2, 20*time.Millisecond)
+			for i, s := range tt.steps {
+				switch s.op {
+				case "success":
+					b.success()
+				case "failure":
+					b.failure()
+				case "take":
+					b.take()
+				case "wait":
+					time.Sleep(30 * time.Millisecond)
+				}
+				if state, ready := b.stateName(), b.ready(); state != s.wantState || ready != s.wantReady {
+					t.Fatalf("step %d %s: got %s ready %v, want %s ready %v", i, s.op, state, ready, s.wantState, s.wantReady)
+				}
+			}
+		})
+	}
+}
+
+// testPool returns pool of instances named by port in port order, ports are not listened
+func testPool(weights map[string]int) *Instances {
+	ports := make([]string, 0, len(weights))
+	for port := range weights {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	pool := NewInstances()
+	for _, port := range ports {
+		pool.AddWeighted(New("127.0.0.1", port, "http", "", nil, nil, nil), weights[port])
+	}
+	pool.StartHealthChecks(HealthConfig{Failures: 1, Cooldown: time.Hour})
+	return pool
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		weights  map[string]int
+		disabled []string
+		ejected  []string
+		want     string // ports of the picks, "" when ErrNoHealthyInstances is expected
+	}{
+		{"equal weights", map[string]int{"a": 1, "b": 1, "c": 1}, nil, nil, "a b c a b c"},
+		{"smooth weighted", map[string]int{"a": 5, "b": 1, "c": 1}, nil, nil, "a a b a c a a"},
+		{"disabled skipped", map[string]int{"a": 1, "b": 1, "c": 1}, []string{"b"}, nil, "a c a c"},
+		{"ejected skipped", map[string]int{"a": 1, "b": 1, "c": 1}, nil, []string{"a"}, "b c b c"},
+		{"all ejected", map[string]int{"a": 1, "b": 1}, nil, []string{"a", "b"}, ""},
+		{"ejected and disabled", map[string]int{"a": 1, "b": 1}, []string{"a"}, []string{"b"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := testPool(tt.weights)
+			defer pool.Close()
+			for _, port := range tt.disabled {
+				pool.SetEnabled("127.0.0.1:"+port, false)
+			}
+			for _, inst := range pool.instances {
+				for _, port := range tt.ejected {
+					if inst.port == port {
+						inst.breaker.failure()
+					}
+				}
+			}
+
+			if tt.want == "" {
+				if inst, err := pool.Next(); err != ErrNoHealthyInstances {
+					t.Fatalf("Next() = %v, %v, want ErrNoHealthyInstances", inst, err)
+				}
+				return
+			}
+			var picks []string
+			for range strings.Fields(tt.want) {
+				inst, err := pool.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				picks = append(picks, inst.port)
+			}
+			if got := strings.Join(picks, " "); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
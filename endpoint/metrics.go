@@ -0,0 +1,28 @@
+package endpoint
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trickyproxy_upstream_requests_total",
+		Help: "Requests sent to upstream endpoints, retries included.",
+	}, []string{"upstream"})
+
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trickyproxy_upstream_errors_total",
+		Help: "Upstream requests that failed after all retries.",
+	}, []string{"upstream"})
+
+	upstreamUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trickyproxy_upstream_up",
+		Help: "Circuit breaker state of upstream, 1 when closed.",
+	}, []string{"upstream"})
+
+	upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trickyproxy_upstream_retries_total",
+		Help: "Upstream request retries after transport errors and retryable statuses.",
+	}, []string{"upstream"})
+)
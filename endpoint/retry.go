@@ -0,0 +1,151 @@
+package endpoint
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy says which failed upstream requests are repeated and how
+type RetryPolicy struct {
+	Attempts   int           // tries of one request, the first one included
+	Backoff    time.Duration // delay before the first retry, doubled for every next one
+	MaxBackoff time.Duration // delay limit
+	Jitter     float64       // random share taken off the delay, 0..1
+	Deadline   time.Duration // time limit for all tries of one request, zero for no limit
+	Methods    []string      // methods repeated after transport errors and retryable statuses
+	Statuses   []int         // response statuses repeated like transport errors
+	Budget     float64       // retries per request over the last 10 seconds, keeps retries from piling on a failing upstream
+}
+
+// DefaultRetryPolicy is used when no settings are given, POST is not repeated unless it is a read-only one
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: 2 * time.Second,
+	Jitter:     0.2,
+	Deadline:   10 * time.Second,
+	Methods:    []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"},
+	Budget:     0.2,
+}
+
+// retryBudgetWindow and retryBudgetMin: at least retryBudgetMin retries are allowed per window
+const (
+	retryBudgetWindow = 10 * time.Second
+	retryBudgetMin    = 10
+)
+
+func (p RetryPolicy) retryMethod(method string) bool {
+	for _, m := range p.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RetryPolicy) retryStatus(status int) bool {
+	for _, s := range p.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns delay before retry number n, starting from 1
+func (p RetryPolicy) backoff(n int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < n && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay - time.Duration(float64(delay)*p.Jitter*rand.Float64())
+}
+
+type retryDeadlineKey struct{}
+
+// WithRetryDeadline sets time after which requests made with ctx are not repeated,
+// so a caller retrying on top of Instance shares one time limit with it
+func WithRetryDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, retryDeadlineKey{}, deadline)
+}
+
+// RetryDeadline returns deadline set by WithRetryDeadline
+func RetryDeadline(ctx context.Context) (deadline time.Time, ok bool) {
+	deadline, ok = ctx.Value(retryDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
+
+type retryCounterKey struct{}
+
+// WithRetryCounter makes requests sent with ctx add their retries to counter, it is changed atomically
+func WithRetryCounter(ctx context.Context, counter *int64) context.Context {
+	return context.WithValue(ctx, retryCounterKey{}, counter)
+}
+
+func countRetry(ctx context.Context) {
+	if counter, ok := ctx.Value(retryCounterKey{}).(*int64); ok {
+		atomic.AddInt64(counter, 1)
+	}
+}
+
+// retryDeadline is the earlier one of the policy deadline and the deadline of ctx, zero for none
+func (p RetryPolicy) retryDeadline(ctx context.Context, start time.Time) (deadline time.Time) {
+	if p.Deadline > 0 {
+		deadline = start.Add(p.Deadline)
+	}
+	if d, ok := RetryDeadline(ctx); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
+
+// retryBudget counts requests and retries of the current and the previous window
+type retryBudget struct {
+	mutex        sync.Mutex
+	ratio        float64
+	windowStart  time.Time
+	requests     [2]int
+	retries      [2]int
+	currentIndex int
+}
+
+func (b *retryBudget) rotate(now time.Time) {
+	if now.Sub(b.windowStart) < retryBudgetWindow {
+		return
+	}
+	if now.Sub(b.windowStart) >= 2*retryBudgetWindow {
+		b.requests, b.retries = [2]int{}, [2]int{}
+	} else {
+		b.currentIndex = 1 - b.currentIndex
+		b.requests[b.currentIndex], b.retries[b.currentIndex] = 0, 0
+	}
+	b.windowStart = now
+}
+
+func (b *retryBudget) request() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rotate(time.Now())
+	b.requests[b.currentIndex]++
+}
+
+// allow takes one retry from the budget if there is one left
+func (b *retryBudget) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rotate(time.Now())
+	requests := b.requests[0] + b.requests[1]
+	retries := b.retries[0] + b.retries[1]
+	if float64(retries) >= b.ratio*float64(requests)+retryBudgetMin {
+		return false
+	}
+	b.retries[b.currentIndex]++
+	return true
+}
@@ -0,0 +1,67 @@
+package endpoint
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{30, time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.backoff(tt.retry); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.retry, got, tt.want)
+		}
+	}
+
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(2); got <= 160*time.Millisecond || got > 200*time.Millisecond {
+			t.Fatalf("backoff(2) with jitter 0.2 = %v, want (160ms, 200ms]", got)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		ratio    float64
+		requests int
+		want     int
+	}{
+		{"no requests", 0.2, 0, retryBudgetMin},
+		{"minimum", 0.2, 20, retryBudgetMin + 4},
+		{"ratio", 0.5, 100, retryBudgetMin + 50},
+		{"no ratio", 0, 100, retryBudgetMin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &retryBudget{ratio: tt.ratio}
+			for i := 0; i < tt.requests; i++ {
+				b.request()
+			}
+			allowed := 0
+			for b.allow() {
+				allowed++
+			}
+			if allowed != tt.want {
+				t.Errorf("allowed %d retries after %d requests, want %d", allowed, tt.requests, tt.want)
+			}
+
+			b.windowStart = b.windowStart.Add(-2 * retryBudgetWindow)
+			if !b.allow() {
+				t.Error("retries of old windows are still counted")
+			}
+		})
+	}
+}
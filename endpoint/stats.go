@@ -0,0 +1,74 @@
+package endpoint
+
+import (
+	"sync/atomic"
+)
+
+// InstanceStats is a snapshot of instance state and counters
+type InstanceStats struct {
+	Name     string `json:"name"`
+	Weight   int    `json:"weight"`
+	Enabled  bool   `json:"enabled"`
+	Healthy  bool   `json:"healthy"`
+	Breaker  string `json:"breaker"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+}
+
+func (inst *Instance) countRequest() {
+	upstreamRequests.WithLabelValues(inst.Name()).Inc()
+	atomic.AddInt64(&inst.requests, 1)
+}
+
+func (inst *Instance) countError() {
+	upstreamErrors.WithLabelValues(inst.Name()).Inc()
+	atomic.AddInt64(&inst.errors, 1)
+}
+
+// Enabled tells if instance may get requests from Instances.Next
+func (inst *Instance) Enabled() bool {
+	return atomic.LoadInt32(&inst.disabled) == 0
+}
+
+// SetEnabled enables or disables instance by name, returns false if there is no such instance
+func (i *Instances) SetEnabled(name string, enabled bool) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var disabled int32 = 1
+	if enabled {
+		disabled = 0
+	}
+	found := false
+	for _, inst := range i.instances {
+		if inst.Name() == name {
+			atomic.StoreInt32(&inst.disabled, disabled)
+			found = true
+		}
+	}
+	return found
+}
+
+// Stats returns state and counters of every instance of the pool
+func (i *Instances) Stats() []InstanceStats {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	stats := make([]InstanceStats, 0, len(i.instances))
+	for idx, inst := range i.instances {
+		breaker := "none"
+		if inst.breaker != nil {
+			breaker = inst.breaker.stateName()
+		}
+		stats = append(stats, InstanceStats{
+			Name:     inst.Name(),
+			Weight:   i.weights[idx],
+			Enabled:  inst.Enabled(),
+			Healthy:  inst.Healthy(),
+			Breaker:  breaker,
+			Requests: atomic.LoadInt64(&inst.requests),
+			Errors:   atomic.LoadInt64(&inst.errors),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,96 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBodyTimeout returned by response body reads which did not finish within BodyTimeout
+var ErrBodyTimeout = errors.New("BODY_TIMEOUT")
+
+// DefaultTimeout limits a whole request, response body included, unless SetTimeout changes it
+const DefaultTimeout = 4 * time.Second
+
+// TransportConfig connection settings of an instance
+type TransportConfig struct {
+	DialTimeout      time.Duration // connect timeout
+	TLSTimeout       time.Duration // TLS handshake timeout
+	HeaderTimeout    time.Duration // wait for response headers after the request is sent, zero for no limit
+	BodyTimeout      time.Duration // read of the response body after the headers, zero for no limit
+	IdleConns        int           // idle keep-alive connections to all hosts
+	IdleConnsPerHost int           // idle keep-alive connections to one host
+	MaxConnsPerHost  int           // connections to one host, zero for no limit
+	IdleTimeout      time.Duration // idle connection is closed after it
+	KeepAlive        time.Duration // TCP keep-alive period, negative disables it
+}
+
+// DefaultTransportConfig is the one of http.DefaultTransport
+var DefaultTransportConfig = TransportConfig{
+	DialTimeout:      30 * time.Second,
+	TLSTimeout:       10 * time.Second,
+	IdleConns:        100,
+	IdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+	IdleTimeout:      90 * time.Second,
+	KeepAlive:        30 * time.Second,
+}
+
+// SetTransport replaces connection settings, client certificate of the instance is kept
+func (inst *Instance) SetTransport(cfg TransportConfig) *Instance {
+	if old, ok := inst.client.Transport.(*http.Transport); ok {
+		old.CloseIdleConnections()
+	}
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	inst.client.Transport = &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       inst.tlsConfig,
+		TLSHandshakeTimeout:   cfg.TLSTimeout,
+		ResponseHeaderTimeout: cfg.HeaderTimeout,
+		MaxIdleConns:          cfg.IdleConns,
+		MaxIdleConnsPerHost:   cfg.IdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleTimeout,
+		DisableCompression:    true, // without this decompress plain data by default.
+	}
+	inst.bodyTimeout = cfg.BodyTimeout
+	return inst
+}
+
+// timedBody cancels the request when the body is not read and closed within the body timeout
+type timedBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	expired int32 // atomic
+}
+
+func newTimedBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *timedBody {
+	b := &timedBody{ReadCloser: body, cancel: cancel}
+	b.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&b.expired, 1)
+		cancel()
+	})
+	return b
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.expired) == 1 {
+		err = ErrBodyTimeout
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
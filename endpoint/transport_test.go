@@ -0,0 +1,85 @@
+package endpoint
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBodyTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		stall   time.Duration
+		wantErr error
+	}{
+		{"fast body", 0, nil},
+		{"stalled body", time.Second, ErrBodyTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello")
+				w.(http.Flusher).Flush()
+				select {
+				case <-time.After(tt.stall):
+					io.WriteString(w, " world")
+				case <-r.Context().Done():
+				}
+			}))
+			defer server.Close()
+			u, _ := url.Parse(server.URL)
+			cfg := DefaultTransportConfig
+			cfg.BodyTimeout = 100 * time.Millisecond
+			inst := New(u.Hostname(), u.Port(), "http", "", nil, nil, nil).SetTransport(cfg)
+
+			resp, err := inst.GetStream("/k1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if _, err = ioutil.ReadAll(resp.Body); err != tt.wantErr {
+				t.Errorf("body read error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// errReader fails reads like a body of a cancelled request
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) { return 0, context.Canceled }
+func (errReader) Close() error               { return nil }
+
+func TestTimedBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		closeFirst  bool
+		wantCancels int32
+		wantErr     error
+	}{
+		{"closed in time", true, 1, context.Canceled},
+		{"expired", false, 1, ErrBodyTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cancels int32
+			body := newTimedBody(ioutil.NopCloser(errReader{}), 20*time.Millisecond, func() { atomic.AddInt32(&cancels, 1) })
+			if tt.closeFirst {
+				body.Close()
+			}
+			time.Sleep(50 * time.Millisecond)
+			if _, err := body.Read(make([]byte, 1)); err != tt.wantErr {
+				t.Errorf("read error %v, want %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(&cancels); got != tt.wantCancels {
+				t.Errorf("request cancelled %d times, want %d", got, tt.wantCancels)
+			}
+		})
+	}
+}
@@ -1,22 +1,32 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/kzub/trickyproxy/endpoint"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type resultStatus int
 
+// client requests being served right now
+var activeRequests int64
+
 const (
 	version   string       = "2.3.0"
 	servOk    resultStatus = iota
@@ -25,15 +35,42 @@ const (
 )
 
 func main() {
-	keyfile := flag.String("key", "certs/service.key", "service private key")
-	crtfile := flag.String("cert", "certs/service.pem", "service public cert")
-	dnrfile := flag.String("donors", "donors.conf", "donors hosts list")
-	trgfile := flag.String("target", "target.conf", "target host address")
-	srvfile := flag.String("srvaddr", "srvaddr.conf", "server host & port to listen")
-	excfile := flag.String("noproxy", "noproxy.conf", "request path exceptions list")
-	stopfile := flag.String("stoplist", "stoplist.conf", "requests stop list")
-	proxmod := flag.String("mode", "riak", "proxy mode: [http | riak]")
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+
+	configFlags := addConfigFlags(flag.CommandLine)
+	proxmod := flag.String("mode", "riak", "proxy mode: ["+strings.Join(modeNames(), " | ")+"]")
 	logformat := flag.String("logformat", "console", "change logformat to json")
+	reloadInterval := flag.Duration("reload", 5*time.Second, "config files check interval, 0 to reload on SIGHUP only")
+	metricsAddr := flag.String("metricsaddr", "127.0.0.1:9902", "prometheus metrics address, empty to disable")
+	metricsPath := flag.String("metrics", "/metrics", "prometheus metrics path on -metricsaddr")
+	shutdownTimeout := flag.Duration("shutdowntimeout", 30*time.Second, "how long to wait for active requests and background 2i backfills on SIGTERM")
+	negSize := flag.Int("negcache", 10000, "max keys in the cache of donor 404 responses, 0 to disable")
+	negTTL := flag.Duration("negcachettl", 30*time.Second, "how long donor 404 responses are cached")
+	opts := newSettings()
+	flag.StringVar(&opts.riakSiblings, "siblings", opts.riakSiblings, "riak siblings copy: [copy | latest]")
+	flag.IntVar(&opts.riak2iWorkers, "2iworkers", opts.riak2iWorkers, "keys of one 2i result filled in parallel")
+	max2iWorkers := flag.Int("2imaxworkers", cap(opts.riak2iSlots), "keys of all 2i results filled in parallel")
+	flag.BoolVar(&opts.riak2iAsync, "2iasync", opts.riak2iAsync, "answer 2i queries before their keys are filled")
+	adminAddr := flag.String("admin", "127.0.0.1:9901", "admin api address, empty to disable")
+	adminToken := flag.String("admintoken", "", "admin api bearer token, TRICKYPROXY_ADMIN_TOKEN env by default, the api is off without it")
+	accessLog := flag.String("accesslog", "stdout", "access log output: stdout, stderr or file path, empty to disable")
+	traceExporter := flag.String("trace", "", "opentelemetry span exporter: [stdout | otlp], empty to disable")
+	traceEndpoint := flag.String("traceendpoint", "", "OTLP/HTTP collector host:port, OTEL_EXPORTER_OTLP_* env when empty")
+	traceSample := flag.Float64("tracesample", 1, "share of traced requests without a sampled client traceparent, 0..1")
+	flag.BoolVar(&opts.dryRun, "dry-run", opts.dryRun, "fetch from donors but only log what would be stored on the target")
+	flag.Float64Var(&opts.shadowRate, "shadow", opts.shadowRate, "share of target hits compared with a donor in background, 0..1")
+	shadowHeaderList := flag.String("shadowheaders", strings.Join(opts.shadowHeaders, ","), "headers compared in shadow mode, comma separated")
+	flag.BoolVar(&opts.shadowJSON, "shadowjson", opts.shadowJSON, "compare JSON bodies by value in shadow mode")
+	maxShadow := flag.Int("shadowmax", cap(opts.shadowSlots), "shadow comparisons in progress, more are skipped")
+	tombstoneFile := flag.String("tombstones", "", "file to keep tombstones of keys deleted through the proxy across restarts, in memory only when empty")
+	flag.BoolVar(&opts.riakMapRedFill, "mapredfill", opts.riakMapRedFill, "copy keys listed in riak mapred inputs from a donor before the job runs")
+	flag.IntVar(&opts.riak2iMaxPages, "2imaxpages", opts.riak2iMaxPages, "max 2i pages filled from the donor on a miss, 0 for no limit")
+	flag.BoolVar(&opts.riakReturnBody, "returnbody", opts.riakReturnBody, "read riak objects back on copy to get their vclock without a HEAD")
+	flag.Int64Var(&opts.spoolMem, "spoolmem", opts.spoolMem, "donor response or client body size kept in memory before spilling to a temp file")
+	flag.StringVar(&opts.spoolDir, "spooldir", opts.spoolDir, "directory for donor response temp files (default system temp dir)")
 	flag.Parse()
 
 	if len(os.Args) > 1 && os.Args[1] == "version" {
@@ -41,6 +78,141 @@ func main() {
 		return
 	}
 
+	logger := newLogger(*logformat)
+	defer logger.Sync()
+
+	undo := zap.ReplaceGlobals(logger)
+	defer undo()
+
+	mode, err := getMode(*proxmod, opts)
+	if err != nil {
+		zap.L().Error("bad proxy mode",
+			zap.String("mode", *proxmod),
+			zap.Strings("available", modeNames()),
+		)
+		os.Exit(1)
+	}
+
+	if opts.riakSiblings != "copy" && opts.riakSiblings != "latest" {
+		zap.L().Error("bad siblings mode",
+			zap.String("siblings", opts.riakSiblings),
+		)
+		os.Exit(1)
+	}
+	if opts.riak2iWorkers < 1 || *max2iWorkers < 1 {
+		zap.L().Error("bad 2i workers",
+			zap.Int("2iworkers", opts.riak2iWorkers),
+			zap.Int("2imaxworkers", *max2iWorkers),
+		)
+		os.Exit(1)
+	}
+	opts.riak2iSlots = make(chan struct{}, *max2iWorkers)
+	if opts.shadowRate < 0 || opts.shadowRate > 1 || *maxShadow < 1 {
+		zap.L().Error("bad shadow settings",
+			zap.Float64("shadow", opts.shadowRate),
+			zap.Int("shadowmax", *maxShadow),
+		)
+		os.Exit(1)
+	}
+	opts.shadowHeaders = nil
+	for _, name := range strings.Split(*shadowHeaderList, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			opts.shadowHeaders = append(opts.shadowHeaders, name)
+		}
+	}
+	opts.shadowSlots = make(chan struct{}, *maxShadow)
+	opts.missCache = newNegativeCache(*negSize, *negTTL)
+	if opts.accessLogger, err = newAccessLogger(*logformat, *accessLog); err != nil {
+		zap.L().Error("cannot open access log",
+			zap.String("accesslog", *accessLog),
+			zap.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+	if *traceSample < 0 || *traceSample > 1 {
+		zap.L().Error("bad trace sample",
+			zap.Float64("tracesample", *traceSample),
+		)
+		os.Exit(1)
+	}
+	stopTracing, err := setupTracing(*traceExporter, *traceEndpoint, *traceSample)
+	if err != nil {
+		zap.L().Error("cannot setup tracing",
+			zap.String("trace", *traceExporter),
+			zap.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+	if *tombstoneFile != "" {
+		if opts.tombstones, err = openTombstones(*tombstoneFile, false); err != nil {
+			zap.L().Error("cannot open tombstones",
+				zap.String("file", *tombstoneFile),
+				zap.String("error", err.Error()),
+			)
+			os.Exit(1)
+		}
+		defer opts.tombstones.Close()
+	}
+
+	loadConfig := configFlags.load
+	watchFiles := configFlags.files()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		zap.L().Error("bad config",
+			zap.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+	rules, err := buildProxyRules(cfg, nil)
+	if err != nil {
+		zap.L().Error("bad config",
+			zap.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+	reloader := newRulesReloader(rules, loadConfig)
+	go reloader.watchSignals()
+	go reloader.watchFiles(*reloadInterval, watchFiles...)
+
+	target := setupTarget(mode, cfg.Target)
+	if *metricsAddr != "" {
+		metrics := startMetrics(*metricsAddr, *metricsPath)
+		defer metrics.Close()
+	}
+	if *adminToken == "" {
+		*adminToken = os.Getenv("TRICKYPROXY_ADMIN_TOKEN")
+	}
+	if *adminAddr != "" && *adminToken != "" {
+		admin := startAdmin(*adminAddr, &adminAPI{
+			token:     *adminToken,
+			mode:      *proxmod,
+			reloader:  reloader,
+			target:    target,
+			vspace:    cfg.Target.VSpace,
+			missCache: opts.missCache,
+		})
+		defer admin.Close()
+	} else {
+		zap.L().Info("admin api disabled, set -admin and -admintoken")
+	}
+	deadline := setupServer(mode, opts, reloader, target, cfg.Target.VSpace, cfg.Listeners.Proxy, *shutdownTimeout)
+	if opts.accessLogger != nil {
+		opts.accessLogger.Sync() // records of the drained requests
+	}
+	waitBackfills(deadline)
+	reloader.Current().donors.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err = stopTracing(ctx); err != nil {
+		zap.L().Error("TRACE_FLUSH_FAILED",
+			zap.String("error", err.Error()),
+		)
+	}
+	cancel()
+	zap.L().Info("server stopped")
+}
+
+func newLogger(format string) *zap.Logger {
 	encoderCfg := zapcore.EncoderConfig{
 		TimeKey:        "@timestamp",
 		LevelKey:       "level",
@@ -62,7 +234,7 @@ func main() {
 			Initial:    100,
 			Thereafter: 100,
 		},
-		Encoding:         *logformat,
+		Encoding:         format,
 		EncoderConfig:    encoderCfg,
 		OutputPaths:      []string{"stdout"},
 		ErrorOutputPaths: []string{"stdout"},
@@ -70,90 +242,63 @@ func main() {
 
 	// logger, _ := zap.NewProduction()
 	logger, _ := logConfig.Build()
-	defer logger.Sync()
-
-	undo := zap.ReplaceGlobals(logger)
-	defer undo()
-
-	if *proxmod == "riak" {
-		setRiakProxyMode()
-	}
-
-	donorsConfig := readConfig(*dnrfile, true)
-	targetConfig := readConfig(*trgfile, true)
-	serverConfig := readConfig(*srvfile, true)
-	exceptionsPaths := readConfig(*excfile, false)
-	stopListPaths := readConfig(*stopfile, false)
-
-	donors := setupDonors(donorsConfig, *keyfile, *crtfile)
-	target := setupTarget(targetConfig)
-	setupServer(donors, target, exceptionsPaths, stopListPaths, serverConfig)
+	return logger
 }
 
-func readConfig(filename string, required bool) string {
+func readConfigFile(filename string, required bool) (string, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		if required {
-			zap.L().Error("cannot read config file",
-				zap.String("filename", filename),
-			)
-			os.Exit(1)
+			return "", err
 		}
-		return ""
+		return "", nil
 	}
 
-	return cleanString(string(data[:]))
+	return cleanString(string(data[:])), nil
 }
 
-func setupDonors(donorsConfig, keyfile, crtfile string) *endpoint.Instances {
-	donorsList := strings.Split(donorsConfig, "\n")
+func setupDonors(donorsConfig []DonorConfig, readOnlyPost checkFunc) (*endpoint.Instances, error) {
 	donors := endpoint.NewInstances()
 
-	for _, val := range donorsList {
-		if len(val) == 0 {
-			continue
-		}
-		data := strings.Split(val, ":")
-
-		protocol := "https"
-		if data[0] == "http" || data[0] == "https" {
-			protocol = data[0]
-			data = data[1:]
-			data[0] = strings.TrimLeft(data[0], "//")
-		}
-
-		host := data[0]
-		port := cleanString(data[1])
-		auth := ""
-		if len(data) > 2 {
-			auth = cleanString(data[2])
+	for _, donor := range donorsConfig {
+		u, err := url.Parse(donor.URL)
+		if err != nil {
+			return nil, errors.New("BAD_DONOR_CONFIG " + donor.URL)
 		}
 		zap.L().Info("adding donor upstream",
-			zap.String("host", host),
-			zap.String("port", port),
+			zap.String("host", u.Hostname()),
+			zap.String("port", u.Port()),
+			zap.Int("weight", donor.Weight),
 		)
 
-		ep := endpoint.NewTLS(protocol, host, port, auth, keyfile, crtfile)
+		ep := endpoint.NewTLSConfig(u.Scheme, u.Hostname(), u.Port(), donor.Auth, donor.TLS.Key, donor.TLS.Cert, donor.TLS.Verify)
+		ep.SetTimeout(donor.Timeout)
+		ep.SetTransport(endpoint.TransportConfig(donor.Transport))
+		ep.SetRetryPolicy(endpoint.RetryPolicy(donor.Retry))
 		ep.MakeReadOnly()
-		donors.Add(ep)
+		ep.AllowReadOnlyPost(readOnlyPost)
+		donors.AddWeighted(ep, donor.Weight)
+	}
+	if donors.Len() == 0 {
+		return nil, errors.New("NO_DONORS_CONFIGURED")
 	}
-	return donors
+	return donors, nil
 }
 
-func setupTarget(targetConfig string) *endpoint.Instance {
-	data := strings.Split(targetConfig, ":")
-	host := data[0]
-	port := cleanString(data[1])
+func setupTarget(mode Mode, targetConfig TargetConfig) *endpoint.Instance {
 	space := ""
-	if len(data) > 2 {
-		space = cleanString(data[2]) + "_"
+	if targetConfig.VSpace != "" {
+		space = targetConfig.VSpace + "_"
 	}
 	zap.L().Info("adding target upstream",
-		zap.String("host", host),
-		zap.String("port", port),
+		zap.String("host", targetConfig.Host),
+		zap.String("port", targetConfig.Port),
 		zap.String("space", space),
 	)
-	return endpoint.New(host, port, "http", "", urlEncoder(space), headerEncoder(space), headerDecoder(space))
+	target := endpoint.New(targetConfig.Host, targetConfig.Port, "http", "", mode.URLEncoder(space), mode.HeaderEncoder(space), mode.HeaderDecoder(space))
+	return target.SetTimeout(targetConfig.Timeout).
+		SetTransport(endpoint.TransportConfig(targetConfig.Transport)).
+		SetRetryPolicy(endpoint.RetryPolicy(targetConfig.Retry))
 }
 
 func cleanString(str string) string {
@@ -167,30 +312,24 @@ func cleanString(str string) string {
 
 type checkFunc func(rURL *url.URL) bool
 
-func buildRegexpFromPath(name, pathListRawData string) checkFunc {
+func buildRegexpFromPath(name string, pathList []string) (checkFunc, error) {
 	var exceptions []*regexp.Regexp
-	if len(pathListRawData) == 0 {
+	if len(pathList) == 0 {
 		zap.L().Info("no paths for",
 			zap.String("name", name),
 		)
 		return func(rURL *url.URL) bool {
 			return false
-		}
+		}, nil
 	}
 
-	data := strings.Split(pathListRawData, "\n")
-
-	for _, v := range data {
+	for _, v := range pathList {
 		if len(v) == 0 {
 			continue
 		}
 		expr, err := regexp.Compile(v)
 		if err != nil {
-			zap.L().Error("bad regexp",
-				zap.String("name", name),
-				zap.String("config", v),
-			)
-			os.Exit(1)
+			return nil, errors.New("BAD_REGEXP " + name + ": " + v)
 		}
 		zap.L().Info("adding path",
 			zap.String("name", name),
@@ -211,105 +350,436 @@ func buildRegexpFromPath(name, pathListRawData string) checkFunc {
 			}
 		}
 		return false
-	}
+	}, nil
 }
 
-func makeHandler(donors *endpoint.Instances, target *endpoint.Instance, exceptionsPaths, stopListPaths string) func(w http.ResponseWriter, r *http.Request) {
-	exceptions := buildRegexpFromPath("exceptions", exceptionsPaths)
-	stopList := buildRegexpFromPath("stoplist", stopListPaths)
+// readOnlyPostFunc returns donor trigger of a read-only POST path, "" for other paths
+type readOnlyPostFunc func(rURL *url.URL) string
 
+func buildReadOnlyPost(rules []ReadOnlyPostRule) (readOnlyPostFunc, error) {
+	type readOnlyPost struct {
+		expr  *regexp.Regexp
+		donor string
+	}
+	var paths []readOnlyPost
+	for _, rule := range rules {
+		expr, err := regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, errors.New("BAD_REGEXP readonlypost: " + rule.Path)
+		}
+		zap.L().Info("adding path",
+			zap.String("name", "readonlypost"),
+			zap.String("path", rule.Path),
+			zap.String("donor", rule.Donor),
+		)
+		paths = append(paths, readOnlyPost{expr: expr, donor: rule.Donor})
+	}
+
+	return func(rURL *url.URL) string {
+		path := rURL.String()
+		for _, p := range paths {
+			if p.expr.MatchString(path) {
+				return p.donor
+			}
+		}
+		return ""
+	}, nil
+}
+
+func makeHandler(mode Mode, opts *settings, reloader *rulesReloader, target *endpoint.Instance, vspace string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if stopList(r.URL) {
+		atomic.AddInt64(&activeRequests, 1)
+		defer atomic.AddInt64(&activeRequests, -1)
+
+		w, r, rec := startAccessRecord(w, r)
+		r, span := startRequestSpan(r, rec)
+		defer func() {
+			observeOutcome(rec.outcome, rec.start)
+			logAccess(opts.accessLogger, r, rec, vspace)
+			endRequestSpan(span, rec)
+		}()
+
+		rules := reloader.Current()
+		if rules.stopList(r.URL) {
 			writeErrorResponse("URL_IN_STOP_LIST "+r.Method, r, w, errors.New("FORBIDDEN REQUEST"))
+			rec.outcome = outcomeStoplist
+			return
+		}
+		if rules.retryDeadline > 0 {
+			r = r.WithContext(endpoint.WithRetryDeadline(r.Context(), rec.start.Add(rules.retryDeadline)))
+		}
+		body, err := spoolRequestBody(opts, r)
+		if err != nil {
+			writeErrorResponse("READ_BODY "+r.Method, r, w, err)
+			rec.outcome = outcomeTargetFail
 			return
 		}
-		for callCount, res := 3, servRetry; res == servRetry && callCount >= 0; callCount-- {
-			res = serveRequest(donors.Next(), target, w, r, exceptions, callCount)
+		defer body.Close()
+		// every donor is tried once at most, each of them repeats failed requests by its retry policy
+		calls := rules.donors.Len()
+		for callCount, res := calls-1, servRetry; res == servRetry && callCount >= 0 && r.Context().Err() == nil; callCount-- {
+			if callCount < calls-1 {
+				atomic.AddInt64(&rec.retries, 1)
+			}
+			res, rec.outcome = serveRequest(mode, opts, rules, target, w, r, callCount)
+		}
+		if rec.outcome == "" {
+			rec.outcome = outcomeClientGone
 		}
 	}
 }
 
-func setupServer(donors *endpoint.Instances, target *endpoint.Instance, exceptionsPaths, stopListPaths, serverAddr string) {
-	http.HandleFunc("/", makeHandler(donors, target, exceptionsPaths, stopListPaths))
+// setupServer serves requests until SIGTERM or SIGINT, then waits up to shutdownTimeout for active requests.
+// It returns the shutdown deadline, the rest of the shutdown must be done before it
+func setupServer(mode Mode, opts *settings, reloader *rulesReloader, target *endpoint.Instance, vspace, serverAddr string, shutdownTimeout time.Duration) (deadline time.Time) {
+	server := &http.Server{Addr: serverAddr, Handler: http.HandlerFunc(makeHandler(mode, opts, reloader, target, vspace))}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+
+		zap.L().Info("shutting down",
+			zap.String("signal", sig.String()),
+			zap.Int64("active_requests", atomic.LoadInt64(&activeRequests)),
+			zap.Duration("timeout", shutdownTimeout),
+		)
+		deadline = time.Now().Add(shutdownTimeout)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			zap.L().Error("SHUTDOWN_TIMEOUT, dropping active requests",
+				zap.Int64("active_requests", atomic.LoadInt64(&activeRequests)),
+			)
+			server.Close()
+		}
+	}()
+
 	zap.L().Info("server ready",
 		zap.String("address", serverAddr),
 	)
-	err := http.ListenAndServe(serverAddr, nil)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
 		zap.L().Error("cannot setup server",
 			zap.String("address", serverAddr),
 		)
 		os.Exit(1)
 	}
+	<-stopped
+	return deadline
 }
 
-func serveRequest(donor *endpoint.Instance, target *endpoint.Instance, w http.ResponseWriter, r *http.Request, noProxyPass checkFunc, callCount int) resultStatus {
-	resp, body, err := target.Do(r)
+func serveRequest(mode Mode, opts *settings, rules *proxyRules, target *endpoint.Instance, w http.ResponseWriter, r *http.Request, callCount int) (resultStatus, proxyOutcome) {
+	donors := rules.donors
+	postTrigger := ""
+	if r.Method == "POST" {
+		postTrigger = rules.readOnlyPost(r.URL)
+	}
+	readOnlyPost := postTrigger != ""
+	if err := rewindBody(r); err != nil {
+		writeErrorResponse("READ_BODY "+r.Method, r, w, err)
+		return servFail, outcomeTargetFail
+	}
+	if postTrigger == donorAlways && !rules.exceptions(r.URL) {
+		return fillFromDonor(mode, opts, donors, target, w, r, callCount, nil)
+	}
+
+	targetStart := time.Now()
+	rq, span := startSpan(mode.RewriteRequest(donors, target, r), "target", attribute.String("peer", target.Name()))
+	resp, err := target.DoStream(rq)
+	if err == nil {
+		accessRecordFrom(r).targetDone(resp.StatusCode, targetStart)
+		endSpan(span, resp.StatusCode, nil)
+	} else {
+		endSpan(span, 0, err)
+	}
 	if err != nil {
+		if r.Context().Err() != nil {
+			return servFail, outcomeClientGone
+		}
 		writeErrorResponse("TARGET_DO_METHOD "+r.Method, r, w, err)
-		return servFail
+		return servFail, outcomeTargetFail
+	}
+	defer resp.Body.Close()
+	body := &lazyBody{reader: resp.Body} // streamed to the client unless a check below needs it
+	if err = mode.RewriteResponse(target, resp, r, body); err != nil {
+		return targetReadFailed(w, r, err)
+	}
+
+	isRead := r.Method == "GET" || r.Method == "HEAD"
+	missKey := negativeKey(target, r.URL.RequestURI())
+	if !isRead && !readOnlyPost {
+		if resp.StatusCode < http.StatusBadRequest {
+			opts.missCache.Remove(missKey)
+		}
+		recordTombstone(opts.tombstones, target, r, resp)
+	}
+
+	if readOnlyPost {
+		// POST bodies differ, so no negative cache and no coalescing
+		data, err := body.Bytes()
+		if err != nil {
+			return targetReadFailed(w, r, err)
+		}
+		if !isEmptyPostResult(resp, data) || rules.exceptions(r.URL) {
+			writeResponse(w, resp, body)
+			return servOk, outcomeTargetHit
+		}
+		if err = rewindBody(r); err != nil {
+			writeErrorResponse("READ_BODY "+r.Method, r, w, err)
+			return servFail, outcomeTargetFail
+		}
+		return fillFromDonor(mode, opts, donors, target, w, r, callCount, nil)
 	}
 
-	if !isNeedProxyPass(resp, r, body) || noProxyPass(r.URL) {
+	needProxyPass := mode.IsNeedProxyPass(resp, r, body.Bytes)
+	if body.err != nil {
+		return targetReadFailed(w, r, body.err)
+	}
+	if !needProxyPass {
+		var data []byte
+		sampled := !rules.exceptions(r.URL) && shadowSampled(opts, r)
+		if sampled {
+			if data, err = body.Bytes(); err != nil {
+				return targetReadFailed(w, r, err)
+			}
+		}
+		writeResponse(w, resp, body)
+		if sampled {
+			shadowCompare(opts, donors, r, resp, data)
+		}
+		return servOk, outcomeTargetHit
+	}
+	if rules.exceptions(r.URL) {
+		writeResponse(w, resp, body)
+		return servOk, outcomeNoProxy
+	}
+	if isRead && opts.missCache.Has(missKey) {
 		writeResponse(w, resp, body)
-		return servOk
+		return servOk, outcomeNegativeHit
 	}
+	if isRead && opts.tombstones.Has(tombstoneKey(target, r.URL.RequestURI())) {
+		writeResponse(w, resp, body)
+		return servOk, outcomeTombstone
+	}
+
+	resp.Body.Close() // the target miss is not needed any more, free its connection
+
+	key := flightKey(target, r)
+	f, leader := donorFlights.join(key)
+	defer f.release()
+	if !leader {
+		if served, outcome := serveFollower(f, w, r); served {
+			return servOk, outcome
+		}
+		return fillFromDonor(mode, opts, donors, target, w, r, callCount, nil)
+	}
+	defer donorFlights.finish(key, f)
+	return fillFromDonor(mode, opts, donors, target, w, r, callCount, f)
+}
 
+// fillFromDonor streams donor response to the client and stores it on the target, the result is shared through f
+func fillFromDonor(mode Mode, opts *settings, donors *endpoint.Instances, target *endpoint.Instance, w http.ResponseWriter, r *http.Request, callCount int, f *flight) (resultStatus, proxyOutcome) {
+	donor, err := donors.Next()
+	if err != nil {
+		writeErrorResponse("NO_HEALTHY_DONORS "+r.Method, r, w, err)
+		return servFail, outcomeDonorFail
+	}
 	zap.L().Info("fetch donor",
-		zap.String("host", r.URL.Host),
+		zap.String("host", donor.Name()),
 	)
-	resp, body, err = donor.Do(r)
+	rec := accessRecordFrom(r)
+	ctx, keep, cancel := fillContext(r.Context())
+	defer cancel()
+	fill := r.WithContext(ctx)
+
+	donorStart := time.Now()
+	rq, span := startSpan(fill, "donor", attribute.String("peer", donor.Name()), attribute.Int("calls_left", callCount))
+	resp, err := donor.DoStream(rq)
 
 	if err != nil {
-		if callCount > 0 {
-			return servRetry
+		endSpan(span, 0, err)
+		if r.Context().Err() != nil {
+			return servFail, outcomeClientGone
+		}
+		if callCount > 0 && retryTimeLeft(r) {
+			return servRetry, outcomeDonorFail
 		}
 		writeErrorResponse("DONOR_DO "+r.Method, r, w, err)
-		return servFail
+		return servFail, outcomeDonorFail
 	}
+	defer resp.Body.Close()
+	keep() // the donor answered, its response is stored even if the client goes away
 
-	storeResult, err := postProcess(donor, target, resp, r, body)
+	// client gets the response while it is spooled for the target
+	spool := opts.newSpool()
+	shared := false
+	defer func() {
+		if !shared {
+			spool.Close()
+		}
+	}()
+	err = streamResponse(w, resp, spool)
+	rec.donorDone(donor.Name(), resp.StatusCode, donorStart)
+	endSpan(span, resp.StatusCode, err)
+	if err != nil {
+		logError("DONOR_STREAM", r, err)
+		return servFail, outcomeDonorStreamFail
+	}
+
+	if r.Method == "POST" {
+		return servOk, outcomeDonorFill // read-only POST, nothing to store
+	}
+
+	// post processing follows the client request, so a 2i backfill stops with it, modes detach the stores themselves
+	rq, span = startSpan(r, "post process")
+	storeResult, err := mode.PostProcess(donor, target, resp, rq, spool)
+	endSpan(span, 0, err)
 	if err != nil {
-		writeErrorResponse("POST_PROCESS", r, w, err)
-		return servFail
+		logError("POST_PROCESS", r, err)
+		return servFail, outcomePostProcessFail
 	}
 
 	if storeResult {
-		err = storeResponse(target, r.URL.String(), resp.Header, body)
+		storeStart := time.Now()
+		rq, span := startSpan(fill, "store", attribute.String("peer", target.Name()))
+		status, err := storeResponse(rq.Context(), opts, donor, target, r.URL.String(), resp.Header, spool)
+		endSpan(span, status, err)
+		rec.stored(status, storeStart)
 		if err != nil {
-			writeErrorResponse("TARGET_STORE", r, w, err)
-			return servFail
+			logError("TARGET_STORE", r, err)
+			return servFail, outcomeTargetStoreFail
 		}
 	}
 
-	writeResponse(w, resp, body)
-	return servOk
+	if resp.StatusCode == http.StatusNotFound && (r.Method == "GET" || r.Method == "HEAD") {
+		opts.missCache.Add(negativeKey(target, r.URL.RequestURI()))
+	}
+	if f != nil {
+		f.share(resp.StatusCode, resp.Header, spool)
+		shared = true
+	}
+	if resp.StatusCode != http.StatusOK {
+		return servOk, outcomeDonorMiss
+	}
+	return servOk, outcomeDonorFill
 }
 
-func writeErrorResponse(msg string, r *http.Request, w http.ResponseWriter, err error) {
+// retryTimeLeft tells if the retry deadline of the request has not passed yet
+func retryTimeLeft(r *http.Request) bool {
+	deadline, ok := endpoint.RetryDeadline(r.Context())
+	return !ok || time.Now().Before(deadline)
+}
+
+// recordTombstone adds tombstone for a DELETE (404 too, the donor may still have the key) and removes it on write
+func recordTombstone(tombstones *tombstoneStore, target *endpoint.Instance, r *http.Request, resp *http.Response) {
+	key := tombstoneKey(target, r.URL.RequestURI())
+	switch {
+	case r.Method == "DELETE" && (resp.StatusCode < http.StatusBadRequest || resp.StatusCode == http.StatusNotFound):
+		tombstones.Add(key)
+	case r.Method != "DELETE" && resp.StatusCode < http.StatusBadRequest:
+		tombstones.Remove(key)
+	}
+}
+
+// spoolRequestBody keeps client body in a spool, so it can be sent to the target, donors and on retries.
+// The spool must be closed when the request is done
+func spoolRequestBody(opts *settings, r *http.Request) (*spoolBuffer, error) {
+	spool := opts.newSpool()
+	if r.Body == nil || r.Body == http.NoBody {
+		return spool, nil
+	}
+	_, err := io.Copy(spool, r.Body)
+	r.Body.Close()
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+	r.GetBody = spool.Open
+	return spool, nil
+}
+
+// rewindBody reopens the spooled client body before it is sent again
+func rewindBody(r *http.Request) (err error) {
+	if r.GetBody == nil {
+		return nil
+	}
+	if r.Body != nil {
+		r.Body.Close()
+	}
+	r.Body, err = r.GetBody()
+	return err
+}
+
+func logError(msg string, r *http.Request, err error) {
 	zap.L().Error(msg,
 		zap.String("url", r.URL.String()),
 		zap.String("error", err.Error()),
 	)
+}
+
+func writeErrorResponse(msg string, r *http.Request, w http.ResponseWriter, err error) {
+	logError(msg, r, err)
 	w.WriteHeader(http.StatusInternalServerError)
 	fmt.Fprintln(w, msg)
 }
 
-func writeResponse(w http.ResponseWriter, resp *http.Response, respBody []byte) {
-	defer func() {
-		if resp.StatusCode >= 500 {
-			zap.L().Info("cli response",
-				zap.String("status", resp.Status),
-				zap.String("url", resp.Request.URL.String()),
-				zap.String("body", string(respBody)),
-			)
-		} else {
-			zap.L().Info("cli response",
-				zap.String("status", resp.Status),
-				zap.String("url", resp.Request.URL.String()),
-			)
-		}
-	}()
+// targetReadFailed answers the client when the target response body can not be read
+func targetReadFailed(w http.ResponseWriter, r *http.Request, err error) (resultStatus, proxyOutcome) {
+	if r.Context().Err() != nil {
+		return servFail, outcomeClientGone
+	}
+	writeErrorResponse("TARGET_READ_BODY "+r.Method, r, w, err)
+	return servFail, outcomeTargetFail
+}
+
+// lazyBody is an upstream response body read whole only when it is needed, otherwise it is streamed to the client
+type lazyBody struct {
+	reader io.Reader
+	read   bool
+	data   []byte
+	err    error
+}
+
+// Bytes reads the whole body once
+func (b *lazyBody) Bytes() ([]byte, error) {
+	if !b.read {
+		b.read = true
+		b.data, b.err = ioutil.ReadAll(b.reader)
+	}
+	return b.data, b.err
+}
+
+// Replace sets the body the client gets
+func (b *lazyBody) Replace(data []byte) {
+	b.read, b.data, b.err = true, data, nil
+}
+
+// WriteTo writes the body read by Bytes or streams it
+func (b *lazyBody) WriteTo(w io.Writer) (int64, error) {
+	if b.read {
+		n, err := w.Write(b.data)
+		return int64(n), err
+	}
+	return io.Copy(w, b.reader)
+}
+
+func writeResponse(w http.ResponseWriter, resp *http.Response, body *lazyBody) {
+	if resp.StatusCode >= 500 {
+		data, _ := body.Bytes() // error answers are small, they are logged with the body
+		zap.L().Info("cli response",
+			zap.String("status", resp.Status),
+			zap.String("url", resp.Request.URL.String()),
+			zap.String("body", string(data)),
+		)
+	} else {
+		zap.L().Info("cli response",
+			zap.String("status", resp.Status),
+			zap.String("url", resp.Request.URL.String()),
+		)
+	}
 
 	headers := w.Header()
 	for k, v := range resp.Header {
@@ -317,5 +787,37 @@ func writeResponse(w http.ResponseWriter, resp *http.Response, respBody []byte)
 	}
 
 	w.WriteHeader(resp.StatusCode)
-	w.Write(respBody)
+	body.WriteTo(w)
+}
+
+// streamResponse writes response to the client and copies its body to the spool at the same time
+func streamResponse(w http.ResponseWriter, resp *http.Response, spool *spoolBuffer) error {
+	headers := w.Header()
+	for k, v := range resp.Header {
+		headers[k] = v
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	tee := &clientTee{client: w, spool: spool}
+	_, err := io.Copy(tee, resp.Body)
+
+	zap.L().Info("cli response",
+		zap.String("status", resp.Status),
+		zap.String("url", resp.Request.URL.String()),
+		zap.Int64("size", spool.Len()),
+	)
+	if err != nil {
+		return err
+	}
+	if tee.clientErr != nil {
+		zap.L().Info("client gone",
+			zap.String("url", resp.Request.URL.String()),
+			zap.String("error", tee.clientErr.Error()),
+		)
+	}
+	// HEAD response has Content-Length of the object but no body
+	if resp.Request.Method != "HEAD" && resp.ContentLength >= 0 && resp.ContentLength != spool.Len() {
+		return errors.New("DONOR_BODY_TRUNCATED")
+	}
+	return nil
 }
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"github.com/kzub/trickyproxy/endpoint"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeStore is a key-value server playing the target or a donor
+type fakeStore struct {
+	mutex    sync.Mutex
+	keys     map[string]string
+	requests []string
+}
+
+func newFakeStore(keys map[string]string) *fakeStore {
+	if keys == nil {
+		keys = make(map[string]string)
+	}
+	return &fakeStore{keys: keys}
+}
+
+func (s *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	switch r.Method {
+	case "GET", "HEAD":
+		value, ok := s.keys[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		io.WriteString(w, value)
+	case "POST", "PUT":
+		s.keys[r.URL.Path] = string(body)
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		delete(s.keys, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeStore) get(path string) (value string, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok = s.keys[path]
+	return value, ok
+}
+
+// startTestUpstreams runs target and donor servers and returns their endpoints
+func startTestUpstreams(t *testing.T, mode Mode, target, donor http.Handler, readOnlyPost checkFunc) (*endpoint.Instance, *endpoint.Instances) {
+	targetServer := httptest.NewServer(target)
+	t.Cleanup(targetServer.Close)
+	donorServer := httptest.NewServer(donor)
+	t.Cleanup(donorServer.Close)
+
+	targetURL, _ := url.Parse(targetServer.URL)
+	targetInstance := setupTarget(mode, TargetConfig{
+		Host:      targetURL.Hostname(),
+		Port:      targetURL.Port(),
+		Transport: TransportConfig(endpoint.DefaultTransportConfig),
+		Retry:     RetryConfig(endpoint.DefaultRetryPolicy),
+	})
+	donors, err := setupDonors([]DonorConfig{{
+		URL:       donorServer.URL,
+		Weight:    1,
+		Transport: TransportConfig(endpoint.DefaultTransportConfig),
+		Retry:     RetryConfig(endpoint.DefaultRetryPolicy),
+	}}, readOnlyPost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(donors.Close)
+	return targetInstance, donors
+}
+
+// startTestProxy runs the proxy handler of the mode in front of target and donor servers
+func startTestProxy(t *testing.T, modeName string, opts *settings, target, donor http.Handler, rulesConfig RulesConfig) *httptest.Server {
+	mode, err := getMode(modeName, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnlyPost, err := buildReadOnlyPost(rulesConfig.ReadOnlyPost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetInstance, donors := startTestUpstreams(t, mode, target, donor, func(rURL *url.URL) bool {
+		return readOnlyPost(rURL) != ""
+	})
+	return startTestHandler(t, mode, opts, targetInstance, donors, rulesConfig)
+}
+
+// startTestHandler runs the proxy handler of the mode in front of target and donor endpoints
+func startTestHandler(t *testing.T, mode Mode, opts *settings, target *endpoint.Instance, donors *endpoint.Instances, rulesConfig RulesConfig) *httptest.Server {
+	exceptions, err := buildRegexpFromPath("exceptions", rulesConfig.NoProxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopList, err := buildRegexpFromPath("stoplist", rulesConfig.StopList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnlyPost, err := buildReadOnlyPost(rulesConfig.ReadOnlyPost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &proxyRules{donors: donors, exceptions: exceptions, stopList: stopList, readOnlyPost: readOnlyPost, config: rulesConfig}
+	proxy := httptest.NewServer(http.HandlerFunc(makeHandler(mode, opts, newRulesReloader(rules, nil), target, "")))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestStreamResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		contentLength int64
+		body          string
+		wantErr       bool
+	}{
+		{"full body", "GET", 5, "hello", false},
+		{"unknown length", "GET", -1, "hello", false},
+		{"truncated body", "GET", 10, "hello", true},
+		{"head", "HEAD", 5, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Status:        "200 OK",
+				Header:        http.Header{},
+				ContentLength: tt.contentLength,
+				Body:          ioutil.NopCloser(strings.NewReader(tt.body)),
+				Request:       httptest.NewRequest(tt.method, "/x/k1", nil),
+			}
+			spool := newSpoolBuffer(1<<20, "")
+			defer spool.Close()
+			w := httptest.NewRecorder()
+			err := streamResponse(w, resp, spool)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("streamResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if w.Body.String() != tt.body || spool.Len() != int64(len(tt.body)) {
+				t.Errorf("client got %q, spool has %d bytes, want %q", w.Body.String(), spool.Len(), tt.body)
+			}
+		})
+	}
+}
+
+func TestHeadMissCopiesFullKey(t *testing.T) {
+	target := newFakeStore(nil)
+	donor := newFakeStore(map[string]string{"/x/k1": "hello"})
+	proxy := startTestProxy(t, "http", newSettings(), target, donor, RulesConfig{})
+
+	resp, err := http.Head(proxy.URL + "/x/k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 5 {
+		t.Fatalf("HEAD got %s with length %d, want 200 OK with length 5", resp.Status, resp.ContentLength)
+	}
+	if value, ok := target.get("/x/k1"); !ok || value != "hello" {
+		t.Errorf("target has %q (%v), want the full key copied from the donor", value, ok)
+	}
+}
+
+func TestReadOnlyPostDonorTrigger(t *testing.T) {
+	tests := []struct {
+		name         string
+		donor        string
+		targetStatus int
+		targetBody   string
+		want         string
+	}{
+		{"target result", donorOnEmpty, http.StatusOK, `[{"k":1}]`, `[{"k":1}]`},
+		{"target 404", donorOnEmpty, http.StatusNotFound, ``, "donor"},
+		{"empty mapred result", donorOnEmpty, http.StatusOK, `[]`, "donor"},
+		{"mapred not_found", donorOnEmpty, http.StatusOK, `[{"not_found":{"bucket":"b","key":"k"}}]`, "donor"},
+		{"empty search result", donorOnEmpty, http.StatusOK, `{"response":{"numFound":0,"docs":[]}}`, "donor"},
+		{"always", donorAlways, http.StatusOK, `[{"k":1}]`, "donor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var targetCalls int32
+			target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&targetCalls, 1)
+				w.WriteHeader(tt.targetStatus)
+				io.WriteString(w, tt.targetBody)
+			})
+			donor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "donor")
+			})
+			proxy := startTestProxy(t, "http", newSettings(), target, donor, RulesConfig{
+				ReadOnlyPost: []ReadOnlyPostRule{{Path: "^/mapred", Donor: tt.donor}},
+			})
+
+			resp, err := http.Post(proxy.URL+"/mapred", "application/json", strings.NewReader(`{"inputs":"b"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.want {
+				t.Errorf("got %q, want %q", body, tt.want)
+			}
+			if tt.donor == donorAlways && atomic.LoadInt32(&targetCalls) != 0 {
+				t.Error("target is asked with donor: always")
+			}
+		})
+	}
+}
+
+func TestLazyBody(t *testing.T) {
+	tests := []struct {
+		name string
+		read bool // Bytes is called before the body is written
+	}{
+		{"streamed", false},
+		{"read first", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &lazyBody{reader: strings.NewReader("hello")}
+			if tt.read {
+				if data, err := body.Bytes(); err != nil || string(data) != "hello" {
+					t.Fatalf("Bytes() = %q, %v", data, err)
+				}
+			}
+			var w strings.Builder
+			if n, err := body.WriteTo(&w); err != nil || n != 5 || w.String() != "hello" {
+				t.Errorf("WriteTo() = %d, %v, wrote %q, want hello", n, err, w.String())
+			}
+		})
+	}
+}
+
+func TestTargetResponseStreamed(t *testing.T) {
+	first := strings.Repeat("a", 64<<10) // over the proxy write buffer, so it reaches the client unflushed
+	release := make(chan struct{})
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, first)
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			io.WriteString(w, "second")
+		case <-time.After(2 * time.Second):
+			io.WriteString(w, "timeout") // the proxy waited for the whole body
+		}
+	})
+	proxy := startTestProxy(t, "http", newSettings(), target, newFakeStore(nil), RulesConfig{})
+
+	resp, err := http.Get(proxy.URL + "/x/k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got := make([]byte, len(first))
+	if _, err = io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	rest, _ := ioutil.ReadAll(resp.Body)
+	if string(rest) != "second" {
+		t.Errorf("got %q after the first part, want the first part before the target finished", rest)
+	}
+}
+
+func TestRequestBodySpooled(t *testing.T) {
+	value := strings.Repeat("v", 100) // over spoolMem, so the body goes to a temp file
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   string // upstream which gets the body
+	}{
+		{"target write", "PUT", "/x/k1", "target"},
+		{"read-only post miss", "POST", "/mapred", "donor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var targetBody, donorBody string
+			target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := ioutil.ReadAll(r.Body)
+				targetBody = string(data)
+				if r.Method == "POST" {
+					io.WriteString(w, "[]") // empty result asks the donor
+				}
+			})
+			donor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := ioutil.ReadAll(r.Body)
+				donorBody = string(data)
+			})
+			opts := newSettings()
+			opts.spoolMem = 10
+			opts.spoolDir = t.TempDir()
+			proxy := startTestProxy(t, "http", opts, target, donor, RulesConfig{
+				ReadOnlyPost: []ReadOnlyPostRule{{Path: "^/mapred", Donor: donorOnEmpty}},
+			})
+
+			r, _ := http.NewRequest(tt.method, proxy.URL+tt.path, strings.NewReader(value))
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if targetBody != value {
+				t.Errorf("target got %d bytes, want %d", len(targetBody), len(value))
+			}
+			if tt.want == "donor" && donorBody != value {
+				t.Errorf("donor got %d bytes, want %d", len(donorBody), len(value))
+			}
+			if files, _ := ioutil.ReadDir(opts.spoolDir); len(files) != 0 {
+				t.Errorf("spool files left: %d", len(files))
+			}
+		})
+	}
+}
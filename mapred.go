@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/kzub/trickyproxy/endpoint"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// riakMapRed returns mapred request for the target with vspace in bucket names, the original one is kept for donors
+func riakMapRed(mode Mode, opts *settings, donors *endpoint.Instances, target *endpoint.Instance, r *http.Request) *http.Request {
+	if r.GetBody == nil {
+		return r
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err == nil {
+		r.Body, err = r.GetBody()
+	}
+	if err != nil {
+		logError("MAPRED_READ_BODY", r, err)
+		return r
+	}
+
+	var job map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err = decoder.Decode(&job); err != nil {
+		logError("BAD_MAPRED_JOB", r, err) // target answers it with a proper error
+		return r
+	}
+
+	encode := mapRedEncoder(target)
+	var keyPaths []string
+	job["inputs"] = rewriteMapRedInputs(job["inputs"], encode, &keyPaths)
+	if query, ok := job["query"].([]interface{}); ok {
+		for _, phase := range query {
+			if p, ok := phase.(map[string]interface{}); ok {
+				if link, ok := p["link"].(map[string]interface{}); ok && link["bucket"] != nil {
+					link["bucket"] = encodeMapRedBucket(link["bucket"], encode)
+				}
+			}
+		}
+	}
+
+	if opts.riakMapRedFill && len(keyPaths) > 0 {
+		donor, err := donors.Next()
+		if err != nil {
+			logError("MAPRED_FILL", r, err)
+		} else {
+			zap.L().Info("fill mapred inputs",
+				zap.Int("keys", len(keyPaths)),
+			)
+			retrieveKeys(r.Context(), mode, opts, donor, target, keyPaths)
+		}
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		logError("MAPRED_ENCODE", r, err)
+		return r
+	}
+	rq := r.Clone(r.Context())
+	rq.ContentLength = int64(len(data))
+	rq.Body = ioutil.NopCloser(bytes.NewReader(data))
+	rq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return rq
+}
+
+// riakMapRedResult removes vspace of the target from bucket names of mapred results, see decodeMapRedResult
+func riakMapRedResult(target *endpoint.Instance, resp *http.Response, body *lazyBody) error {
+	encode := mapRedEncoder(target)
+	prefix := strings.TrimSuffix(encode("b"), "b")
+	if prefix == "" {
+		return nil // no vspace
+	}
+	data, err := body.Bytes()
+	if err != nil {
+		return err
+	}
+
+	var result interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if decoder.Decode(&result) != nil {
+		return nil // an error message or a non-JSON result goes as is
+	}
+	decode := func(bucket string) (string, bool) {
+		if !strings.HasPrefix(bucket, prefix) {
+			return bucket, false
+		}
+		return strings.TrimPrefix(bucket, prefix), true
+	}
+	if !decodeMapRedResult(result, decode) {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err = encoder.Encode(result); err != nil {
+		return err
+	}
+	data = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	body.Replace(data)
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// mapRedEncoder returns function which gives bucket name with vspace of the target
+func mapRedEncoder(target *endpoint.Instance) func(string) string {
+	return func(bucket string) string {
+		path := target.EncodePath("/buckets/" + bucket + "/")
+		return strings.TrimSuffix(strings.TrimPrefix(path, "/buckets/"), "/")
+	}
+}
+
+// decodeMapRedResult decodes buckets of link phase results [bucket, key(, tag)] and {"not_found": {"bucket": ...}}
+// entries at any depth, it tells if something was decoded. Values returned by map and reduce phases are
+// decoded as well when they look like [bucket, key] with the vspace prefix, there is no telling them apart
+func decodeMapRedResult(result interface{}, decode func(string) (string, bool)) (decoded bool) {
+	switch res := result.(type) {
+	case map[string]interface{}:
+		if notFound, ok := res["not_found"].(map[string]interface{}); ok {
+			if bucket, ok := notFound["bucket"].(string); ok {
+				notFound["bucket"], decoded = decode(bucket)
+			}
+		}
+	case []interface{}:
+		if len(res) == 2 || len(res) == 3 {
+			if _, ok := res[1].(string); ok {
+				if bucketType, bucket := mapRedBucket(res[0]); bucket != "" {
+					if name, ok := decode(bucket); ok {
+						if bucketType == "" {
+							res[0] = name
+						} else {
+							res[0] = []interface{}{bucketType, name}
+						}
+						return true
+					}
+				}
+			}
+		}
+		for _, entry := range res {
+			if decodeMapRedResult(entry, decode) {
+				decoded = true
+			}
+		}
+	}
+	return decoded
+}
+
+// rewriteMapRedInputs encodes buckets of all input forms and collects paths of [bucket, key] inputs:
+// "bucket", ["type", "bucket"], [[bucket, key(, keydata)], ...] and {"bucket": bucket, ...} (2i, key filters)
+func rewriteMapRedInputs(inputs interface{}, encode func(string) string, keyPaths *[]string) interface{} {
+	switch in := inputs.(type) {
+	case string:
+		return encode(in)
+	case map[string]interface{}:
+		if in["bucket"] != nil {
+			in["bucket"] = encodeMapRedBucket(in["bucket"], encode)
+		}
+	case []interface{}:
+		if bucketType, bucket := mapRedBucket(in); bucket != "" {
+			return []interface{}{bucketType, encode(bucket)}
+		}
+		for _, entry := range in {
+			e, ok := entry.([]interface{})
+			if !ok || len(e) < 2 {
+				continue
+			}
+			key, ok := e[1].(string)
+			bucketType, bucket := mapRedBucket(e[0])
+			if !ok || bucket == "" {
+				continue
+			}
+			keyPath := "/buckets/" + url.PathEscape(bucket) + "/keys/" + url.PathEscape(key)
+			if bucketType != "" {
+				keyPath = "/types/" + url.PathEscape(bucketType) + keyPath
+			}
+			*keyPaths = append(*keyPaths, keyPath)
+			e[0] = encodeMapRedBucket(e[0], encode)
+		}
+	}
+	return inputs
+}
+
+// isEmptyPostResult tells if a read-only POST found nothing on the target: 404, an empty body or JSON array,
+// riak mapred result with not_found entries or a search response with numFound 0
+func isEmptyPostResult(resp *http.Response, body []byte) bool {
+	if resp.StatusCode == http.StatusNotFound {
+		return true
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if body = bytes.TrimSpace(body); len(body) == 0 {
+		return true
+	}
+
+	var result interface{}
+	if json.Unmarshal(body, &result) != nil {
+		return false
+	}
+	switch res := result.(type) {
+	case []interface{}:
+		return len(res) == 0 || hasNotFound(res)
+	case map[string]interface{}:
+		if response, ok := res["response"].(map[string]interface{}); ok {
+			numFound, ok := response["numFound"].(float64)
+			return ok && numFound == 0
+		}
+	}
+	return false
+}
+
+// hasNotFound looks for {"not_found": ...} entries of missing mapred inputs, phase results may be nested
+func hasNotFound(entries []interface{}) bool {
+	for _, entry := range entries {
+		switch e := entry.(type) {
+		case map[string]interface{}:
+			if _, ok := e["not_found"]; ok {
+				return true
+			}
+		case []interface{}:
+			if hasNotFound(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mapRedBucket reads "bucket" or ["type", "bucket"]
+func mapRedBucket(v interface{}) (bucketType, bucket string) {
+	switch b := v.(type) {
+	case string:
+		return "", b
+	case []interface{}:
+		if len(b) == 2 {
+			t, ok1 := b[0].(string)
+			name, ok2 := b[1].(string)
+			if ok1 && ok2 {
+				return t, name
+			}
+		}
+	}
+	return "", ""
+}
+
+func encodeMapRedBucket(v interface{}, encode func(string) string) interface{} {
+	bucketType, bucket := mapRedBucket(v)
+	if bucket == "" {
+		return v
+	}
+	if bucketType == "" {
+		return encode(bucket)
+	}
+	return []interface{}{bucketType, encode(bucket)}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/kzub/trickyproxy/endpoint"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsEmptyPostResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   bool
+	}{
+		{"not found", http.StatusNotFound, "not found", true},
+		{"server error", http.StatusInternalServerError, "", false},
+		{"empty body", http.StatusOK, " \n", true},
+		{"empty array", http.StatusOK, "[]", true},
+		{"mapred result", http.StatusOK, `[{"name":"a"},{"name":"b"}]`, false},
+		{"mapred not_found", http.StatusOK, `[{"name":"a"},{"not_found":{"bucket":"b","key":"k","keydata":"undefined"}}]`, true},
+		{"phase not_found", http.StatusOK, `[[1,2],[{"not_found":{"bucket":"b","key":"k"}}]]`, true},
+		{"search hits", http.StatusOK, `{"response":{"numFound":2,"docs":[{},{}]}}`, false},
+		{"search no hits", http.StatusOK, `{"response":{"numFound":0,"docs":[]}}`, true},
+		{"other object", http.StatusOK, `{"count":0}`, false},
+		{"not json", http.StatusOK, "plain text", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status}
+			if got := isEmptyPostResult(resp, []byte(tt.body)); got != tt.want {
+				t.Errorf("isEmptyPostResult(%d, %s) = %v, want %v", tt.status, tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteMapRedInputs(t *testing.T) {
+	tests := []struct {
+		name         string
+		inputs       string
+		want         string
+		wantKeyPaths []string
+	}{
+		{"bucket", `"b"`, `"dev_b"`, nil},
+		{"typed bucket", `["t","b"]`, `["t","dev_b"]`, nil},
+		{"keys", `[["b","k1"],["b","k2","data"]]`, `[["dev_b","k1"],["dev_b","k2","data"]]`,
+			[]string{"/buckets/b/keys/k1", "/buckets/b/keys/k2"}},
+		{"typed keys", `[[["t","b"],"k1"]]`, `[[["t","dev_b"],"k1"]]`, []string{"/types/t/buckets/b/keys/k1"}},
+		{"escaped key", `[["b","a b/c"]]`, `[["dev_b","a b/c"]]`, []string{"/buckets/b/keys/a%20b%2Fc"}},
+		{"2i", `{"bucket":"b","index":"f_bin","key":"v"}`, `{"bucket":"dev_b","index":"f_bin","key":"v"}`, nil},
+		{"typed key filters", `{"bucket":["t","b"],"key_filters":[["eq","k"]]}`, `{"bucket":["t","dev_b"],"key_filters":[["eq","k"]]}`, nil},
+		{"bad entries", `[["b"],"k",[1,"k"]]`, `[["b"],"k",[1,"k"]]`, nil},
+	}
+	encode := func(bucket string) string { return "dev_" + bucket }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inputs, want interface{}
+			if err := json.Unmarshal([]byte(tt.inputs), &inputs); err != nil {
+				t.Fatal(err)
+			}
+			json.Unmarshal([]byte(tt.want), &want)
+			var keyPaths []string
+			got := rewriteMapRedInputs(inputs, encode, &keyPaths)
+			if !reflect.DeepEqual(got, want) {
+				data, _ := json.Marshal(got)
+				t.Errorf("rewriteMapRedInputs(%s) = %s, want %s", tt.inputs, data, tt.want)
+			}
+			if !reflect.DeepEqual(keyPaths, tt.wantKeyPaths) {
+				t.Errorf("key paths = %q, want %q", keyPaths, tt.wantKeyPaths)
+			}
+		})
+	}
+}
+
+func TestRiakMapRedResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		vspace string
+		body   string
+		want   string
+	}{
+		{"link phase", "db1", `[["db1_b","k","friend"],["db1_b","k2"]]`, `[["b","k","friend"],["b","k2"]]`},
+		{"typed link phase", "db1", `[[["t","db1_b"],"k","friend"]]`, `[[["t","b"],"k","friend"]]`},
+		{"kept phases", "db1", `[[1,2],[["db1_b","k","friend"]]]`, `[[1,2],[["b","k","friend"]]]`},
+		{"not_found", "db1", `[{"not_found":{"bucket":"db1_b","key":"k","keydata":"undefined"}}]`,
+			`[{"not_found":{"bucket":"b","key":"k","keydata":"undefined"}}]`},
+		{"not json", "db1", `[<html>, {"name": "a"}, 12345678901234567890]`, `[<html>, {"name": "a"}, 12345678901234567890]`},
+		{"map values", "db1", `[{"name": "a"}, ["other","k"]]`, `[{"name": "a"}, ["other","k"]]`},
+		{"numbers and html", "db1", `[["db1_b","<k>"],12345678901234567890]`, `[["b","<k>"],12345678901234567890]`},
+		{"no vspace", "", `[["db1_b","k","friend"]]`, `[["db1_b","k","friend"]]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := setupTarget(riakMode{opts: newSettings()}, TargetConfig{Host: "127.0.0.1", Port: "8098", VSpace: tt.vspace})
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, ContentLength: int64(len(tt.body))}
+			body := &lazyBody{reader: strings.NewReader(tt.body)}
+			if err := riakMapRedResult(target, resp, body); err != nil {
+				t.Fatal(err)
+			}
+			var got strings.Builder
+			body.WriteTo(&got)
+			if got.String() != tt.want {
+				t.Errorf("got %s, want %s", got.String(), tt.want)
+			}
+			if resp.ContentLength != int64(len(tt.want)) {
+				t.Errorf("content length %d, want %d", resp.ContentLength, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestMapRedThroughProxy(t *testing.T) {
+	var targetJob string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		targetJob = string(data)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `[["db1_b","k2","friend"]]`)
+	}))
+	t.Cleanup(targetServer.Close)
+	targetURL, _ := url.Parse(targetServer.URL)
+	mode := riakMode{opts: newSettings()}
+	target := setupTarget(mode, TargetConfig{
+		Host:      targetURL.Hostname(),
+		Port:      targetURL.Port(),
+		VSpace:    "db1",
+		Transport: TransportConfig(endpoint.DefaultTransportConfig),
+		Retry:     RetryConfig(endpoint.DefaultRetryPolicy),
+	})
+	_, donors := startTestUpstreams(t, mode, newFakeStore(nil), newFakeStore(nil), nil)
+	proxy := startTestHandler(t, mode, mode.opts, target, donors, RulesConfig{})
+
+	job := `{"inputs":[["b","k"]],"query":[{"link":{"bucket":"b","tag":"friend"}}]}`
+	resp, err := http.Post(proxy.URL+"/mapred", "application/json", strings.NewReader(job))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := `{"inputs":[["db1_b","k"]],"query":[{"link":{"bucket":"db1_b","tag":"friend"}}]}`; targetJob != want {
+		t.Errorf("target got %s, want %s", targetJob, want)
+	}
+	if want := `[["b","k2","friend"]]`; string(body) != want || resp.ContentLength != int64(len(want)) {
+		t.Errorf("client got %s with length %d, want %s", body, resp.ContentLength, want)
+	}
+}
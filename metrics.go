@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type proxyOutcome string
+
+// outcomes of a single client request
+const (
+	outcomeTargetHit       proxyOutcome = "target_hit"
+	outcomeNoProxy         proxyOutcome = "noproxy"
+	outcomeNegativeHit     proxyOutcome = "negative_hit"
+	outcomeTombstone       proxyOutcome = "tombstone"
+	outcomeDonorFill       proxyOutcome = "donor_fill"
+	outcomeDonorMiss       proxyOutcome = "donor_miss"
+	outcomeStoplist        proxyOutcome = "stoplist"
+	outcomeTargetFail      proxyOutcome = "target_fail"
+	outcomeDonorFail       proxyOutcome = "donor_fail"
+	outcomeDonorStreamFail proxyOutcome = "donor_stream_fail"
+	outcomePostProcessFail proxyOutcome = "post_process_fail"
+	outcomeTargetStoreFail proxyOutcome = "target_store_fail"
+	outcomeClientGone      proxyOutcome = "client_gone"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trickyproxy_requests_total",
+		Help: "Client requests by outcome.",
+	}, []string{"outcome"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trickyproxy_request_duration_seconds",
+		Help:    "Client request latency by outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"outcome"})
+
+	coalescedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trickyproxy_coalesced_total",
+		Help: "Requests that waited for an in-flight donor fetch of the same key.",
+	}, []string{"kind"})
+
+	negativeCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "trickyproxy_negative_cache_hits_total",
+		Help: "Requests answered 404 from the negative cache without donor lookup.",
+	})
+
+	negativeCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "trickyproxy_negative_cache_size",
+		Help: "Keys in the negative cache.",
+	})
+
+	tombstonesSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "trickyproxy_tombstones",
+		Help: "Keys deleted through the proxy, never copied from donors again.",
+	})
+
+	shadowComparisons = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trickyproxy_shadow_comparisons_total",
+		Help: "Target hits compared with a donor, by result.",
+	}, []string{"result"})
+
+	shadowMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trickyproxy_shadow_mismatches_total",
+		Help: "Differences between target and donor responses, by field.",
+	}, []string{"field"})
+
+	secondaryIndexKeysTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trickyproxy_2i_keys_total",
+		Help: "Keys retrieved while filling 2i results and mapred inputs, by result.",
+	}, []string{"result"})
+
+	secondaryIndexBackfills = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "trickyproxy_2i_backfills_active",
+		Help: "2i results being filled in background after the client got the answer.",
+	})
+)
+
+// outcomeCounts request counts by outcome for the admin API
+var outcomeCounts = struct {
+	sync.Mutex
+	counts map[proxyOutcome]int64
+}{counts: make(map[proxyOutcome]int64)}
+
+func observeOutcome(outcome proxyOutcome, start time.Time) {
+	outcomeCounts.Lock()
+	outcomeCounts.counts[outcome]++
+	outcomeCounts.Unlock()
+	requestsTotal.WithLabelValues(string(outcome)).Inc()
+	requestDuration.WithLabelValues(string(outcome)).Observe(time.Since(start).Seconds())
+}
+
+// startMetrics serves prometheus metrics on their own listener in background, so they are not exposed
+// on the proxy address and do not shadow a proxied path. The returned server is closed on shutdown
+func startMetrics(addr, path string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		zap.L().Info("metrics ready",
+			zap.String("address", addr),
+			zap.String("path", path),
+		)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			zap.L().Error("cannot setup metrics",
+				zap.String("address", addr),
+				zap.String("error", err.Error()),
+			)
+		}
+	}()
+	return server
+}
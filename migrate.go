@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kzub/trickyproxy/endpoint"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// migrateCheckpoint is saved after every page of keys, so an interrupted migration can resume
+// and keys that failed are tried again
+type migrateCheckpoint struct {
+	Buckets map[string]*bucketProgress `json:"buckets"`
+}
+
+// bucketProgress of a bucket, it is done when all keys are listed and none of them failed
+type bucketProgress struct {
+	Continuation string   `json:"continuation,omitempty"`
+	Listed       bool     `json:"listed"`
+	Done         bool     `json:"done"`
+	Copied       int64    `json:"copied"`
+	Present      int64    `json:"present"`
+	Failed       int64    `json:"failed"`
+	FailedKeys   []string `json:"failed_keys,omitempty"`
+}
+
+type migrator struct {
+	mode        Mode
+	donors      *endpoint.Instances
+	target      *endpoint.Instance
+	concurrency int
+	pageSize    int
+	listKeys    bool
+	limiter     <-chan time.Time
+	checkpoint  *migrateCheckpoint
+	ckptFile    string
+	opts        *settings
+	mutex       sync.Mutex // guards FailedKeys
+}
+
+// runMigrate copies whole riak buckets from donors to the target:
+// trickyproxy migrate [flags] [type/]bucket [[type/]bucket...]
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configFlags := addConfigFlags(flags)
+	logformat := flags.String("logformat", "console", "change logformat to json")
+	concurrency := flags.Int("concurrency", 8, "keys copied in parallel")
+	rate := flags.Float64("rate", 0, "max keys per second, 0 for no limit")
+	pageSize := flags.Int("pagesize", 1000, "keys per $bucket index page")
+	listKeys := flags.Bool("listkeys", false, "enumerate keys with list-keys instead of the $bucket index")
+	ckptFile := flags.String("checkpoint", "migrate.checkpoint.json", "progress file to resume from")
+	opts := newSettings()
+	flags.BoolVar(&opts.riakReturnBody, "returnbody", opts.riakReturnBody, "read riak objects back on copy to get their vclock without a HEAD")
+	flags.BoolVar(&opts.dryRun, "dry-run", opts.dryRun, "read keys from donors but only log what would be stored on the target")
+	tombstoneFile := flags.String("tombstones", "", "tombstones file of the proxy, deleted keys are skipped")
+	progress := flags.Duration("progress", 10*time.Second, "progress log interval")
+	flags.Parse(args)
+
+	logger := newLogger(*logformat)
+	defer logger.Sync()
+	undo := zap.ReplaceGlobals(logger)
+	defer undo()
+
+	buckets := flags.Args()
+	if len(buckets) == 0 || *concurrency < 1 || *pageSize < 1 {
+		fmt.Fprintln(os.Stderr, "usage: trickyproxy migrate [flags] [type/]bucket [[type/]bucket...]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	mode, _ := getMode("riak", opts)
+	cfg, err := configFlags.load()
+	if err != nil {
+		zap.L().Error("bad config",
+			zap.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+	donors, err := setupDonors(cfg.Donors, nil)
+	if err != nil {
+		zap.L().Error("bad config",
+			zap.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+	donors.StartHealthChecks(endpoint.HealthConfig(cfg.Health))
+	defer donors.Close()
+
+	if *tombstoneFile != "" {
+		if opts.tombstones, err = openTombstones(*tombstoneFile, true); err != nil {
+			zap.L().Error("cannot open tombstones",
+				zap.String("file", *tombstoneFile),
+				zap.String("error", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+
+	checkpoint, err := loadCheckpoint(*ckptFile)
+	if err != nil {
+		zap.L().Error("bad checkpoint",
+			zap.String("file", *ckptFile),
+			zap.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+
+	m := &migrator{
+		mode:        mode,
+		donors:      donors,
+		target:      setupTarget(mode, cfg.Target),
+		concurrency: *concurrency,
+		pageSize:    *pageSize,
+		listKeys:    *listKeys,
+		checkpoint:  checkpoint,
+		ckptFile:    *ckptFile,
+		opts:        opts,
+	}
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		m.limiter = ticker.C
+	}
+
+	for _, bucket := range buckets {
+		m.progress(bucket)
+	}
+	stopProgress := make(chan struct{})
+	go m.logProgress(*progress, stopProgress)
+
+	failed := false
+	for _, bucket := range buckets {
+		if err = m.migrateBucket(bucket); err != nil {
+			failed = true
+			zap.L().Error("BUCKET_MIGRATION_FAILED",
+				zap.String("bucket", bucket),
+				zap.String("error", err.Error()),
+			)
+		}
+	}
+	close(stopProgress)
+
+	for _, bucket := range buckets {
+		p := m.progress(bucket)
+		fmt.Printf("%s: copied %d, present %d, failed %d, done %v\n",
+			bucket, atomic.LoadInt64(&p.Copied), atomic.LoadInt64(&p.Present), atomic.LoadInt64(&p.Failed), p.Done)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func loadCheckpoint(filename string) (*migrateCheckpoint, error) {
+	checkpoint := &migrateCheckpoint{Buckets: make(map[string]*bucketProgress)}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, checkpoint); err != nil {
+		return nil, err
+	}
+	if checkpoint.Buckets == nil {
+		checkpoint.Buckets = make(map[string]*bucketProgress)
+	}
+	return checkpoint, nil
+}
+
+func (m *migrator) progress(bucket string) *bucketProgress {
+	p, ok := m.checkpoint.Buckets[bucket]
+	if !ok {
+		p = &bucketProgress{}
+		m.checkpoint.Buckets[bucket] = p
+	}
+	return p
+}
+
+// saveCheckpoint writes checkpoint through a temp file, so it is never half written
+func (m *migrator) saveCheckpoint() error {
+	if m.opts.dryRun {
+		return nil // a dry run must not mark buckets migrated
+	}
+	data, err := json.MarshalIndent(m.checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.ckptFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.ckptFile)
+}
+
+func (m *migrator) migrateBucket(bucket string) error {
+	p := m.progress(bucket)
+	if p.Done {
+		zap.L().Info("bucket already migrated",
+			zap.String("bucket", bucket),
+		)
+		return nil
+	}
+
+	if !p.Listed && m.listKeys {
+		// list-keys can not continue from a position, an unfinished listing starts over
+		atomic.StoreInt64(&p.Copied, 0)
+		atomic.StoreInt64(&p.Present, 0)
+		atomic.StoreInt64(&p.Failed, 0)
+		p.FailedKeys = nil
+	}
+	if len(p.FailedKeys) > 0 {
+		keys := p.FailedKeys
+		zap.L().Info("retry failed keys",
+			zap.String("bucket", bucket),
+			zap.Int("keys", len(keys)),
+		)
+		p.FailedKeys = nil
+		atomic.AddInt64(&p.Failed, -int64(len(keys)))
+		m.copyKeys(bucket, keys, p)
+		if err := m.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+
+	if !p.Listed {
+		if err := m.walkBucket(bucket, p); err != nil {
+			return err
+		}
+		p.Listed = true
+		p.Continuation = ""
+	}
+
+	p.Done = len(p.FailedKeys) == 0
+	if err := m.saveCheckpoint(); err != nil {
+		return err
+	}
+	if !p.Done {
+		return errors.New("KEYS_FAILED " + strconv.Itoa(len(p.FailedKeys)) + ", run again to retry them")
+	}
+	return nil
+}
+
+// walkBucket copies keys of the bucket page by page, the $bucket index walk saves its position after every page
+func (m *migrator) walkBucket(bucket string, p *bucketProgress) error {
+	if m.listKeys {
+		return m.listBucketKeys(bucket, func(keys []string) error {
+			m.copyKeys(bucket, keys, p)
+			return nil
+		})
+	}
+	for {
+		keys, continuation, err := m.indexPage(bucket, p.Continuation)
+		if err != nil {
+			return err
+		}
+		m.copyKeys(bucket, keys, p)
+		if continuation == "" {
+			return nil
+		}
+		p.Continuation = continuation
+		if err = m.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+}
+
+// riakBucketPath returns path and name of "bucket" or "type/bucket" argument
+func riakBucketPath(bucket string) (path, name string) {
+	if idx := strings.Index(bucket, "/"); idx >= 0 {
+		name = bucket[idx+1:]
+		return "/types/" + url.PathEscape(bucket[:idx]) + "/buckets/" + url.PathEscape(name), name
+	}
+	return "/buckets/" + url.PathEscape(bucket), bucket
+}
+
+// indexPage reads one page of the $bucket index
+func (m *migrator) indexPage(bucket, continuation string) (keys []string, next string, err error) {
+	query := url.Values{}
+	query.Set("max_results", strconv.Itoa(m.pageSize))
+	if continuation != "" {
+		query.Set("continuation", continuation)
+	}
+	bucketPath, name := riakBucketPath(bucket)
+	path := bucketPath + "/index/$bucket/" + url.PathEscape(name) + "?" + query.Encode()
+
+	donor, err := m.donors.Next()
+	if err != nil {
+		return nil, "", err
+	}
+	resp, body, err := donor.Get(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New("DONOR_INDEX_STATUS " + resp.Status)
+	}
+
+	var page struct {
+		Keys         []string `json:"keys"`
+		Continuation string   `json:"continuation"`
+	}
+	if err = json.Unmarshal(body, &page); err != nil {
+		return nil, "", err
+	}
+	return page.Keys, page.Continuation, nil
+}
+
+// listBucketKeys streams list-keys response and passes keys in batches of pageSize
+func (m *migrator) listBucketKeys(bucket string, batch func(keys []string) error) error {
+	donor, err := m.donors.Next()
+	if err != nil {
+		return err
+	}
+	bucketPath, _ := riakBucketPath(bucket)
+	resp, err := donor.GetStream(bucketPath + "/keys?keys=stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("DONOR_LIST_KEYS_STATUS " + resp.Status)
+	}
+
+	var keys []string
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var chunk struct {
+			Keys []string `json:"keys"`
+		}
+		err = decoder.Decode(&chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, chunk.Keys...)
+		for len(keys) >= m.pageSize {
+			if err = batch(keys[:m.pageSize]); err != nil {
+				return err
+			}
+			keys = keys[m.pageSize:]
+		}
+	}
+	if len(keys) > 0 {
+		return batch(keys)
+	}
+	return nil
+}
+
+// copyKeys copies keys with a pool of workers and returns when all of them are done
+func (m *migrator) copyKeys(bucket string, keys []string, p *bucketProgress) {
+	queue := make(chan string)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < m.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				m.copyKey(bucket, key, p)
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		if m.limiter != nil {
+			<-m.limiter
+		}
+		queue <- key
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func (m *migrator) copyKey(bucket, key string, p *bucketProgress) {
+	bucketPath, _ := riakBucketPath(bucket)
+	keyPath := bucketPath + "/keys/" + url.PathEscape(key)
+
+	donor, err := m.donors.Next()
+	if err == nil {
+		var stored bool
+		if stored, err = retrieveKey(context.Background(), m.mode, m.opts, donor, m.target, keyPath); err == nil {
+			if stored {
+				atomic.AddInt64(&p.Copied, 1)
+			} else {
+				atomic.AddInt64(&p.Present, 1)
+			}
+			return
+		}
+	}
+
+	atomic.AddInt64(&p.Failed, 1)
+	m.mutex.Lock()
+	p.FailedKeys = append(p.FailedKeys, key)
+	m.mutex.Unlock()
+	zap.L().Error("MIGRATE_KEY_FAILED",
+		zap.String("key", keyPath),
+		zap.String("error", err.Error()),
+	)
+}
+
+func (m *migrator) logProgress(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for bucket, p := range m.checkpoint.Buckets {
+			zap.L().Info("migrate progress",
+				zap.String("bucket", bucket),
+				zap.Int64("copied", atomic.LoadInt64(&p.Copied)),
+				zap.Int64("present", atomic.LoadInt64(&p.Present)),
+				zap.Int64("failed", atomic.LoadInt64(&p.Failed)),
+			)
+		}
+	}
+}
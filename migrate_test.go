@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMigrateBucketRetriesFailedKeys(t *testing.T) {
+	var broken int32 = 1
+	keys := newFakeStore(map[string]string{"/buckets/b/keys/k1": "one", "/buckets/b/keys/k2": "two"})
+	donor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/buckets/b/index/$bucket/b":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"keys":["k1","k2"]}`))
+		case r.URL.Path == "/buckets/b/keys/k2" && atomic.LoadInt32(&broken) == 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			keys.ServeHTTP(w, r)
+		}
+	})
+	target := newFakeStore(nil)
+	opts := newSettings()
+	targetInstance, donors := startTestUpstreams(t, riakMode{opts: opts}, target, donor, nil)
+
+	ckptFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	newMigrator := func() *migrator {
+		checkpoint, err := loadCheckpoint(ckptFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &migrator{
+			mode:        riakMode{opts: opts},
+			donors:      donors,
+			target:      targetInstance,
+			concurrency: 2,
+			pageSize:    10,
+			checkpoint:  checkpoint,
+			ckptFile:    ckptFile,
+			opts:        opts,
+		}
+	}
+
+	if err := newMigrator().migrateBucket("b"); err == nil {
+		t.Fatal("run with a failed key must fail")
+	}
+	m := newMigrator()
+	p := m.progress("b")
+	if p.Done || !p.Listed || p.Copied != 1 || p.Failed != 1 || len(p.FailedKeys) != 1 || p.FailedKeys[0] != "k2" {
+		t.Fatalf("checkpoint after the failed run: %+v", *p)
+	}
+
+	atomic.StoreInt32(&broken, 0)
+	if err := m.migrateBucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	p = newMigrator().progress("b")
+	if !p.Done || p.Copied != 2 || p.Failed != 0 || len(p.FailedKeys) != 0 {
+		t.Fatalf("checkpoint after the retry: %+v", *p)
+	}
+	if _, ok := target.get("/buckets/b/keys/k2"); !ok {
+		t.Error("failed key is not copied by the second run")
+	}
+}
+
+func TestMigrateBucketTypes(t *testing.T) {
+	tests := []struct {
+		name       string
+		bucket     string
+		listKeys   bool
+		bucketPath string
+	}{
+		{"index", "b", false, "/buckets/b"},
+		{"typed index", "t/b", false, "/types/t/buckets/b"},
+		{"list keys", "b", true, "/buckets/b"},
+		{"typed list keys", "t/b", true, "/types/t/buckets/b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := newFakeStore(map[string]string{tt.bucketPath + "/keys/k1": "one"})
+			donor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == tt.bucketPath+"/index/$bucket/b" && !tt.listKeys,
+					r.URL.Path == tt.bucketPath+"/keys" && r.URL.Query().Get("keys") == "stream" && tt.listKeys:
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte(`{"keys":["k1"]}`))
+				default:
+					keys.ServeHTTP(w, r)
+				}
+			})
+			target := newFakeStore(nil)
+			opts := newSettings()
+			targetInstance, donors := startTestUpstreams(t, riakMode{opts: opts}, target, donor, nil)
+			ckptFile := filepath.Join(t.TempDir(), "checkpoint.json")
+			checkpoint, _ := loadCheckpoint(ckptFile)
+			m := &migrator{
+				mode:        riakMode{opts: opts},
+				donors:      donors,
+				target:      targetInstance,
+				concurrency: 1,
+				pageSize:    10,
+				listKeys:    tt.listKeys,
+				checkpoint:  checkpoint,
+				ckptFile:    ckptFile,
+				opts:        opts,
+			}
+
+			if err := m.migrateBucket(tt.bucket); err != nil {
+				t.Fatal(err)
+			}
+			if value, ok := target.get(tt.bucketPath + "/keys/k1"); !ok || value != "one" {
+				t.Errorf("target has %q (%v) at %s/keys/k1, want the key copied", value, ok, tt.bucketPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/kzub/trickyproxy/endpoint"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+// negativeCache is a bounded set of missing keys with TTL
+type negativeCache struct {
+	keys *lruCache
+}
+
+func newNegativeCache(size int, ttl time.Duration) *negativeCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &negativeCache{keys: newLRUCache(size, ttl)}
+}
+
+// negativeKey is the target path of the key, query is ignored
+func negativeKey(target *endpoint.Instance, path string) string {
+	if idx := strings.Index(path, "?"); idx >= 0 {
+		path = path[:idx]
+	}
+	return target.Name() + target.EncodePath(path)
+}
+
+func (c *negativeCache) Add(key string) {
+	if c == nil {
+		return
+	}
+	c.keys.Set(key, true)
+	negativeCacheSize.Set(float64(c.keys.Len()))
+}
+
+// Has tells if key is known to be missing
+func (c *negativeCache) Has(key string) bool {
+	if c == nil {
+		return false
+	}
+	if _, ok := c.keys.Get(key); !ok {
+		negativeCacheSize.Set(float64(c.keys.Len()))
+		return false
+	}
+	negativeCacheHits.Inc()
+	zap.L().Info("negative cache hit",
+		zap.String("key", key),
+		zap.Int("size", c.keys.Len()),
+	)
+	return true
+}
+
+// Remove forgets key, called when the key is written through the proxy
+func (c *negativeCache) Remove(key string) {
+	if c == nil {
+		return
+	}
+	c.keys.Remove(key)
+	negativeCacheSize.Set(float64(c.keys.Len()))
+}
+
+func (c *negativeCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	return c.keys.Len()
+}
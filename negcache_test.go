@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	if cache := newNegativeCache(0, time.Second); cache != nil || cache.Has("a") {
+		t.Fatal("cache of size 0 is not disabled")
+	}
+
+	cache := newNegativeCache(2, 50*time.Millisecond)
+	cache.Add("a")
+	if !cache.Has("a") || cache.Has("b") {
+		t.Fatalf("got a %v, b %v, want only a", cache.Has("a"), cache.Has("b"))
+	}
+	cache.Remove("a")
+	if cache.Has("a") {
+		t.Error("removed key is still cached")
+	}
+
+	cache.Add("a")
+	cache.Add("b")
+	cache.Add("c")
+	if cache.Has("a") || cache.Len() != 2 {
+		t.Errorf("got a %v with %d keys, want a evicted and 2 keys", cache.Has("a"), cache.Len())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if cache.Has("c") {
+		t.Error("expired key is still cached")
+	}
+}
+
+func TestNegativeCacheProxy(t *testing.T) {
+	// after a donor 404 the key is cached until a write goes through the proxy
+	tests := []struct {
+		name       string
+		method     string
+		wantCached bool
+	}{
+		{"get", "GET", true},
+		{"put", "PUT", false},
+		{"delete", "DELETE", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newSettings()
+			opts.missCache = newNegativeCache(10, time.Minute)
+			target := newFakeStore(nil)
+			donor := newFakeStore(nil)
+			proxy := startTestProxy(t, "http", opts, target, donor, RulesConfig{})
+
+			for _, method := range []string{"GET", tt.method} {
+				rq, _ := http.NewRequest(method, proxy.URL+"/x/k1?r=1", strings.NewReader("hello"))
+				resp, err := http.DefaultClient.Do(rq)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+			donor.mutex.Lock()
+			donorCalls := len(donor.requests)
+			donor.mutex.Unlock()
+			if donorCalls != 1 {
+				t.Errorf("donor got %d requests, want 1", donorCalls)
+			}
+			if cached := opts.missCache.Len() == 1; cached != tt.wantCached {
+				t.Errorf("key cached %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestStoreResponseClearsNegativeCache(t *testing.T) {
+	opts := newSettings()
+	opts.missCache = newNegativeCache(10, time.Minute)
+	target, donors := startTestUpstreams(t, httpMode{opts: opts}, newFakeStore(nil), newFakeStore(nil), nil)
+	donor, _ := donors.Next()
+	key := negativeKey(target, "/x/k1")
+	opts.missCache.Add(key)
+
+	body := opts.newSpool()
+	defer body.Close()
+	body.Write([]byte("hello"))
+	if _, err := storeResponse(context.Background(), opts, donor, target, "/x/k1?r=1", http.Header{}, body); err != nil {
+		t.Fatal(err)
+	}
+	if opts.missCache.Has(key) {
+		t.Error("stored key is still cached as missing")
+	}
+}
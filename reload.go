@@ -0,0 +1,185 @@
+package main
+
+import (
+	"github.com/kzub/trickyproxy/endpoint"
+	"go.uber.org/zap"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// proxyRules holds the part of configuration that can be changed without restart
+type proxyRules struct {
+	donors       *endpoint.Instances
+	exceptions   checkFunc
+	stopList     checkFunc
+	readOnlyPost readOnlyPostFunc
+	config       RulesConfig
+	// retryDeadline limits donor failover and upstream retries of one client request together
+	retryDeadline time.Duration
+	// cfg is the whole config the rules are built of, nil for rules made by hand
+	cfg *Config
+}
+
+// buildProxyRules builds rules of cfg, donors of old rules are kept when their config is the same,
+// so breakers, counters and health checks survive a reload. old is nil on start
+func buildProxyRules(cfg *Config, old *proxyRules) (*proxyRules, error) {
+	exceptions, err := buildRegexpFromPath("exceptions", cfg.Rules.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+	stopList, err := buildRegexpFromPath("stoplist", cfg.Rules.StopList)
+	if err != nil {
+		return nil, err
+	}
+	readOnlyPost, err := buildReadOnlyPost(cfg.Rules.ReadOnlyPost)
+	if err != nil {
+		return nil, err
+	}
+
+	var donors *endpoint.Instances
+	if old != nil && old.cfg != nil && sameDonors(old.cfg, cfg) {
+		donors = old.donors
+	} else {
+		donors, err = setupDonors(cfg.Donors, func(rURL *url.URL) bool {
+			return readOnlyPost(rURL) != ""
+		})
+		if err != nil {
+			return nil, err
+		}
+		donors.StartHealthChecks(endpoint.HealthConfig(cfg.Health))
+	}
+
+	return &proxyRules{
+		donors:        donors,
+		exceptions:    exceptions,
+		stopList:      stopList,
+		readOnlyPost:  readOnlyPost,
+		config:        cfg.Rules,
+		retryDeadline: cfg.Retry.Deadline,
+		cfg:           cfg,
+	}, nil
+}
+
+// sameDonors tells if the donor pool of old config serves the new one as is,
+// donors check read-only POST with the rules they are built with
+func sameDonors(old, cfg *Config) bool {
+	return reflect.DeepEqual(old.Donors, cfg.Donors) &&
+		old.Health == cfg.Health &&
+		reflect.DeepEqual(old.Rules.ReadOnlyPost, cfg.Rules.ReadOnlyPost)
+}
+
+// rulesReloader swaps proxyRules atomically, invalid config never replaces the active one
+type rulesReloader struct {
+	current atomic.Value
+	load    func() (*Config, error)
+	mutex   sync.Mutex
+	// started is the config the target and listeners run with, they change only on restart
+	started *Config
+}
+
+func newRulesReloader(rules *proxyRules, load func() (*Config, error)) *rulesReloader {
+	reloader := &rulesReloader{load: load, started: rules.cfg}
+	reloader.current.Store(rules)
+	return reloader
+}
+
+// Current returns active rules, keep the result for the whole request
+func (rl *rulesReloader) Current() *proxyRules {
+	return rl.current.Load().(*proxyRules)
+}
+
+// Reload loads and validates config, the active rules stay in place on error
+func (rl *rulesReloader) Reload() error {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	old := rl.Current()
+	cfg, err := rl.load()
+	var rules *proxyRules
+	if err == nil {
+		rules, err = buildProxyRules(cfg, old)
+	}
+	if err != nil {
+		zap.L().Error("CONFIG_RELOAD_FAILED, keep previous config",
+			zap.String("error", err.Error()),
+		)
+		return err
+	}
+	rl.warnRestart(cfg)
+
+	rl.current.Store(rules)
+	if rules.donors != old.donors {
+		for _, donor := range old.donors.Stats() {
+			if !donor.Enabled {
+				rules.donors.SetEnabled(donor.Name, false) // donors disabled through admin API stay disabled
+			}
+		}
+		old.donors.Close()
+	}
+
+	zap.L().Info("config reloaded",
+		zap.Int("donors", rules.donors.Len()),
+		zap.Bool("donors_kept", rules.donors == old.donors),
+	)
+	return nil
+}
+
+// warnRestart logs target and listener changes, a reload does not apply them
+func (rl *rulesReloader) warnRestart(cfg *Config) {
+	if rl.started == nil {
+		return
+	}
+	if !reflect.DeepEqual(rl.started.Target, cfg.Target) {
+		zap.L().Warn("target config changed, restart to apply it")
+	}
+	if rl.started.Listeners != cfg.Listeners {
+		zap.L().Warn("listeners config changed, restart to apply it")
+	}
+}
+
+func (rl *rulesReloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		zap.L().Info("SIGHUP received, reloading config")
+		rl.Reload()
+	}
+}
+
+// watchFiles reloads config when modification time or size of any file changes
+func (rl *rulesReloader) watchFiles(interval time.Duration, files ...string) {
+	if interval <= 0 {
+		return
+	}
+
+	state := filesState(files)
+	for range time.Tick(interval) {
+		newState := filesState(files)
+		if newState == state {
+			continue
+		}
+		state = newState
+		zap.L().Info("config files changed, reloading config")
+		rl.Reload()
+	}
+}
+
+func filesState(files []string) string {
+	var state string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			state += file + ":missing;"
+			continue
+		}
+		state += file + ":" + info.ModTime().String() + ":" + strconv.FormatInt(info.Size(), 10) + ";"
+	}
+	return state
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadKeepsDonors(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(cfg *Config)
+		wantKept bool
+		wantWarn string // restart warning
+	}{
+		{"rules only", func(cfg *Config) { cfg.Rules.NoProxy = []string{"^/x/"} }, true, ""},
+		{"retry deadline", func(cfg *Config) { cfg.Retry.Deadline = time.Second }, true, ""},
+		{"donor weight", func(cfg *Config) { cfg.Donors[0].Weight = 2 }, false, ""},
+		{"new donor", func(cfg *Config) { cfg.Donors = append(cfg.Donors, cfg.Donors[0]) }, false, ""},
+		{"health", func(cfg *Config) { cfg.Health.Failures = 3 }, false, ""},
+		{"read-only post", func(cfg *Config) {
+			cfg.Rules.ReadOnlyPost = []ReadOnlyPostRule{{Path: "^/mapred", Donor: donorOnEmpty}}
+		}, false, ""},
+		{"target", func(cfg *Config) { cfg.Target.VSpace = "db2" }, true, "target config changed, restart to apply it"},
+		{"listener", func(cfg *Config) { cfg.Listeners.Proxy = ":9000" }, true, "listeners config changed, restart to apply it"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			donors := []string{"http://127.0.0.1:8001"}
+			loadDonors := testConfigLoader(&donors)
+			changed := false
+			reloader := startTestReloader(t, func() (*Config, error) {
+				cfg, err := loadDonors()
+				cfg.Target.VSpace = "db1"
+				cfg.Listeners.Proxy = ":8000"
+				if changed {
+					tt.change(cfg)
+				}
+				return cfg, err
+			})
+			old := reloader.Current()
+			old.donors.SetEnabled("127.0.0.1:8001", false)
+
+			core, logs := observer.New(zap.WarnLevel)
+			defer zap.ReplaceGlobals(zap.New(core))()
+			changed = true
+			if err := reloader.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			rules := reloader.Current()
+			if rules == old {
+				t.Fatal("rules are not replaced")
+			}
+			if kept := rules.donors == old.donors; kept != tt.wantKept {
+				t.Errorf("donor pool kept %v, want %v", kept, tt.wantKept)
+			}
+			if stats := rules.donors.Stats(); stats[0].Enabled {
+				t.Errorf("disabled donor is enabled after reload")
+			}
+			var warns []string
+			for _, entry := range logs.FilterMessageSnippet("restart").All() {
+				warns = append(warns, entry.Message)
+			}
+			if got := strings.Join(warns, "; "); got != tt.wantWarn {
+				t.Errorf("got warnings %q, want %q", got, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestReloadInvalidConfigKeepsRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config) error
+	}{
+		{"load error", func(cfg *Config) error { return errors.New("CANNOT_READ_CONFIG") }},
+		{"bad noproxy regexp", func(cfg *Config) error { cfg.Rules.NoProxy = []string{"(("}; return nil }},
+		{"bad stoplist regexp", func(cfg *Config) error { cfg.Rules.StopList = []string{"(("}; return nil }},
+		{"bad donor url", func(cfg *Config) error { cfg.Donors[0].URL = "http://%zz"; return nil }},
+		{"no donors", func(cfg *Config) error { cfg.Donors = nil; return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			donors := []string{"http://127.0.0.1:8001"}
+			loadDonors := testConfigLoader(&donors)
+			changed := false
+			reloader := startTestReloader(t, func() (*Config, error) {
+				cfg, _ := loadDonors()
+				cfg.Rules.NoProxy = []string{"^/old/"}
+				if changed {
+					if err := tt.change(cfg); err != nil {
+						return nil, err
+					}
+				}
+				return cfg, nil
+			})
+			old := reloader.Current()
+
+			changed = true
+			if err := reloader.Reload(); err == nil {
+				t.Fatal("invalid config is loaded")
+			}
+			rules := reloader.Current()
+			if rules != old {
+				t.Fatal("rules are replaced by invalid config")
+			}
+			if oldPath, _ := url.Parse("/old/k1"); !rules.exceptions(oldPath) {
+				t.Error("old noproxy rule is lost")
+			}
+			if _, err := rules.donors.Next(); err != nil {
+				t.Errorf("old donors are closed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/kzub/trickyproxy/endpoint"
+	"go.uber.org/zap"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// riakObjectPath matches /riak/<bucket>/<key> and [/types/<type>]/buckets/<bucket>/keys/<key>
+var riakObjectPath = regexp.MustCompile("^(?:/riak/([^/]+)/([^/]+)|(/types/[^/]+)?/buckets/([^/]+)/keys/([^/]+))$")
+
+// riakVclocks maps vclocks the clients got from donors to vclocks of the copied objects on the target
+var riakVclocks = newLRUCache(100000, time.Hour)
+
+type riakSibling struct {
+	header       http.Header
+	body         *spoolBuffer
+	lastModified time.Time
+}
+
+func vclockKey(target *endpoint.Instance, path, vclock string) string {
+	return negativeKey(target, path) + " " + vclock
+}
+
+// riakRewriteVclock replaces donor vclock of a write with the target one, so the write does not create siblings.
+// A vclock missing in riakVclocks (after restart or expiry) is resolved with HEAD requests
+func riakRewriteVclock(donors *endpoint.Instances, target *endpoint.Instance, r *http.Request) {
+	if r.Method != "PUT" && r.Method != "POST" && r.Method != "DELETE" {
+		return
+	}
+	vclock := r.Header.Get("X-Riak-Vclock")
+	path := getPathFromURL(r.URL)
+	if vclock == "" || !riakObjectPath.MatchString(path) {
+		return
+	}
+	var targetVclock string
+	if cached, ok := riakVclocks.Get(vclockKey(target, path, vclock)); ok {
+		targetVclock = cached.(string)
+	} else if targetVclock = resolveRiakVclock(r.Context(), donors, target, path, vclock); targetVclock == "" {
+		return
+	}
+	r.Header.Set("X-Riak-Vclock", targetVclock)
+	zap.L().Info("vclock rewritten",
+		zap.String("url", path),
+	)
+}
+
+// resolveRiakVclock returns target vclock of the object when vclock is not the target one but the donor one, "" otherwise
+func resolveRiakVclock(ctx context.Context, donors *endpoint.Instances, target *endpoint.Instance, path, vclock string) string {
+	resp, err := target.HeadContext(ctx, path)
+	if err != nil || (resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultipleChoices) {
+		return ""
+	}
+	current := resp.Header.Get("X-Riak-Vclock")
+	if current == "" || current == vclock {
+		return "" // the client has the target object
+	}
+	donor, err := donors.Next()
+	if err != nil {
+		return ""
+	}
+	resp, err = donor.HeadContext(ctx, path)
+	if err != nil || resp.Header.Get("X-Riak-Vclock") != vclock {
+		return "" // stale vclock, riak handles it as usual
+	}
+	riakVclocks.Set(vclockKey(target, path, vclock), current)
+	zap.L().Info("vclock resolved",
+		zap.String("url", path),
+		zap.String("donor", donor.Name()),
+	)
+	return current
+}
+
+// copyRiakKey is copyKey which counts target siblings as present and copies donor siblings
+func copyRiakKey(ctx context.Context, opts *settings, donor, target *endpoint.Instance, keyPath string) (stored bool, err error) {
+	zap.L().Info("RETRIEVE KEY >>>>",
+		zap.String("key", keyPath),
+	)
+	resp, err := target.HeadContext(ctx, keyPath)
+	if err != nil {
+		return false, errors.New("TARGET_GET_KEY")
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusMultipleChoices {
+		return false, nil // already there
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return false, errors.New("TARGET_GET_KEY " + resp.Status)
+	}
+
+	resp, err = donor.GetStreamContext(ctx, keyPath)
+	if err != nil {
+		return false, errors.New("DONOR_GET_KEY")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil // nothing to copy
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultipleChoices {
+		return false, errors.New("DONOR_GET_KEY " + resp.Status)
+	}
+
+	spool := opts.newSpool()
+	defer spool.Close()
+	if _, err = io.Copy(spool, resp.Body); err != nil {
+		return false, errors.New("DONOR_READ_KEY")
+	}
+	if _, err = storeRiakResponse(ctx, opts, donor, target, keyPath, resp, spool); err != nil {
+		return false, errors.New("TARGET_WRITE_KEY")
+	}
+
+	return true, nil
+}
+
+// storeRiakResponse stores donor object or its siblings on the target and remembers the target vclock,
+// status is the one of the last store request, 0 if nothing was stored
+func storeRiakResponse(ctx context.Context, opts *settings, donor, target *endpoint.Instance, path string, resp *http.Response, body *spoolBuffer) (status int, err error) {
+	var stored *http.Response
+	if resp.StatusCode == http.StatusMultipleChoices {
+		stored, err = storeRiakSiblings(ctx, opts, donor, target, path, resp, body)
+	} else {
+		stored, err = storeRiakObject(ctx, opts, donor, target, path, resp.Header, body)
+	}
+	if stored != nil {
+		status = stored.StatusCode
+	}
+	if err != nil || stored == nil {
+		return status, err
+	}
+
+	donorVclock := resp.Header.Get("X-Riak-Vclock")
+	if donorVclock == "" {
+		return status, nil
+	}
+	vclock := stored.Header.Get("X-Riak-Vclock") // only with returnbody
+	if vclock == "" {
+		head, err := target.HeadContext(ctx, path)
+		if err != nil {
+			return status, err
+		}
+		vclock = head.Header.Get("X-Riak-Vclock")
+	}
+	if vclock != "" {
+		riakVclocks.Set(vclockKey(target, path, donorVclock), vclock)
+	}
+	return status, nil
+}
+
+// storeRiakObject PUTs object to /buckets/<b>/keys/<k>, response is nil in dry-run
+func storeRiakObject(ctx context.Context, opts *settings, donor, target *endpoint.Instance, path string, header http.Header, body *spoolBuffer) (resp *http.Response, err error) {
+	putPath := riakKeysPath(path)
+	if opts.dryRun {
+		logDryRun(donor, target, "PUT", putPath, body.Len())
+		return nil, nil
+	}
+	if opts.riakReturnBody {
+		putPath += "?returnbody=true"
+	}
+	resp, respBody, err := target.PutStreamContext(ctx, putPath, riakStoreHeaders(header), body.Len(), body.Open)
+	if err != nil {
+		return nil, err
+	}
+	// 300 is a stored sibling when returnbody is on
+	if resp.StatusCode > http.StatusMultipleChoices {
+		zap.L().Info("store status",
+			zap.String("status", resp.Status),
+			zap.String("body", string(respBody)),
+		)
+		return resp, errors.New("TARGET_STORE_STATUS " + resp.Status)
+	}
+	opts.missCache.Remove(negativeKey(target, path))
+
+	zap.L().Info("store status",
+		zap.String("status", resp.Status),
+	)
+	return resp, nil
+}
+
+// riakKeysPath converts /riak/<b>/<k> to /buckets/<b>/keys/<k>, typed paths are kept
+func riakKeysPath(path string) string {
+	m := riakObjectPath.FindStringSubmatch(path)
+	if m == nil {
+		return path
+	}
+	if m[1] != "" {
+		return "/buckets/" + m[1] + "/keys/" + m[2]
+	}
+	return m[3] + "/buckets/" + m[4] + "/keys/" + m[5]
+}
+
+// riakStoreHeaders keeps object metadata only, Link values get vspace from the target header encoder
+func riakStoreHeaders(header http.Header) http.Header {
+	h := make(http.Header)
+	for k, v := range header {
+		switch {
+		case k == "Content-Type" || k == "Content-Encoding":
+			h[k] = v
+		case k == "Link":
+			if links := riakTagLinks(v); len(links) > 0 {
+				h[k] = links
+			}
+		case strings.HasPrefix(k, "X-Riak-Meta-") || strings.HasPrefix(k, "X-Riak-Index-"):
+			h[k] = v
+		}
+	}
+	return h
+}
+
+// riakTagLinks drops rel="up" links riak adds to every response
+func riakTagLinks(values []string) (links []string) {
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			if link = strings.TrimSpace(link); strings.Contains(link, "riaktag=") {
+				links = append(links, link)
+			}
+		}
+	}
+	if len(links) == 0 {
+		return nil
+	}
+	return []string{strings.Join(links, ", ")}
+}
+
+// storeRiakSiblings writes every live sibling to the target without vclock, riak keeps them as siblings
+func storeRiakSiblings(ctx context.Context, opts *settings, donor, target *endpoint.Instance, path string, resp *http.Response, body *spoolBuffer) (stored *http.Response, err error) {
+	siblings, err := loadRiakSiblings(ctx, opts, donor, path, resp, body)
+	defer func() {
+		for _, s := range siblings {
+			s.body.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if len(siblings) == 0 {
+		return nil, nil // all siblings are tombstones
+	}
+
+	sort.SliceStable(siblings, func(i, j int) bool {
+		return siblings[i].lastModified.Before(siblings[j].lastModified)
+	})
+	store := siblings
+	if opts.riakSiblings == "latest" {
+		store = siblings[len(siblings)-1:]
+	}
+
+	zap.L().Info("store siblings",
+		zap.String("url", path),
+		zap.Int("siblings", len(store)),
+	)
+	for _, s := range store {
+		if stored, err = storeRiakObject(ctx, opts, donor, target, path, s.header, s.body); err != nil {
+			return stored, err
+		}
+	}
+	return stored, nil
+}
+
+// loadRiakSiblings parses multipart/mixed body, donor is asked again if the client got only the vtag list
+func loadRiakSiblings(ctx context.Context, opts *settings, donor *endpoint.Instance, path string, resp *http.Response, body *spoolBuffer) (siblings []riakSibling, err error) {
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var reader io.ReadCloser
+	if mediaType == "multipart/mixed" {
+		reader, err = body.Open()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		url, _ := url.Parse(path)
+		all, err := donor.DoStreamContext(ctx, &http.Request{
+			Method: "GET",
+			URL:    url,
+			Header: http.Header{"Accept": []string{"multipart/mixed"}},
+		})
+		if err != nil {
+			return nil, errors.New("DONOR_GET_SIBLINGS")
+		}
+		if all.StatusCode != http.StatusMultipleChoices {
+			all.Body.Close()
+			return nil, errors.New("DONOR_GET_SIBLINGS " + all.Status)
+		}
+		mediaType, params, _ = mime.ParseMediaType(all.Header.Get("Content-Type"))
+		reader = all.Body
+	}
+	defer reader.Close()
+	if mediaType != "multipart/mixed" || params["boundary"] == "" {
+		return nil, errors.New("BAD_SIBLINGS_CONTENT_TYPE")
+	}
+
+	parts := multipart.NewReader(reader, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return siblings, err
+		}
+		if strings.EqualFold(part.Header.Get("X-Riak-Deleted"), "true") {
+			continue
+		}
+
+		s := riakSibling{header: make(http.Header), body: opts.newSpool()}
+		for k, v := range part.Header {
+			s.header[k] = v
+		}
+		s.lastModified, _ = http.ParseTime(part.Header.Get("Last-Modified"))
+		siblings = append(siblings, s)
+		if _, err = io.Copy(s.body, part); err != nil {
+			return siblings, err
+		}
+	}
+	return siblings, nil
+}
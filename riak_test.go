@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestRiakStoreHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string // "" when the header is dropped
+	}{
+		{"Content-Type", "application/json", "application/json"},
+		{"Content-Encoding", "gzip", "gzip"},
+		{"Content-Length", "5", ""},
+		{"Date", "Mon, 02 Jan 2006 15:04:05 GMT", ""},
+		{"Server", "MochiWeb/1.1 WebMachine/1.10.9", ""},
+		{"Etag", `"3VhRP0vnXbk5NjZllr0dDE"`, ""},
+		{"Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT", ""},
+		{"X-Riak-Vclock", "a85hYGBgzGDKBVIc", ""},
+		{"X-Riak-Meta-Owner", "kzub", "kzub"},
+		{"X-Riak-Index-Email_bin", "a@b.c", "a@b.c"},
+		{"Link", `</buckets/b>; rel="up", </buckets/b/keys/k2>; riaktag="friend"`, `</buckets/b/keys/k2>; riaktag="friend"`},
+		{"Link", `</buckets/b>; rel="up"`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := riakStoreHeaders(http.Header{tt.name: {tt.value}})
+			if got.Get(tt.name) != tt.want || (tt.want == "" && len(got) != 0) {
+				t.Errorf("riakStoreHeaders() = %v, want %s: %q", got, tt.name, tt.want)
+			}
+		})
+	}
+}
+
+func TestRiakTagLinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"up only", []string{`</buckets/b>; rel="up"`}, nil},
+		{"no links", nil, nil},
+		{"tag among up", []string{`</buckets/b>; rel="up", </riak/b/k2>; riaktag="friend"`}, []string{`</riak/b/k2>; riaktag="friend"`}},
+		{
+			"several values",
+			[]string{`</buckets/b/keys/k2>; riaktag="a"`, `</buckets/b>; rel="up",</buckets/b/keys/k3>; riaktag="b"`},
+			[]string{`</buckets/b/keys/k2>; riaktag="a", </buckets/b/keys/k3>; riaktag="b"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := riakTagLinks(tt.values); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("riakTagLinks() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRiakKeysPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/riak/b/k", "/buckets/b/keys/k"},
+		{"/buckets/b/keys/k", "/buckets/b/keys/k"},
+		{"/types/t/buckets/b/keys/k", "/types/t/buckets/b/keys/k"},
+		{"/riak/b", "/riak/b"},
+		{"/buckets/b/index/f_bin/v", "/buckets/b/index/f_bin/v"},
+		{"/x/k1", "/x/k1"},
+	}
+	for _, tt := range tests {
+		if got := riakKeysPath(tt.path); got != tt.want {
+			t.Errorf("riakKeysPath(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+// riakVclockServer answers HEAD of the paths with their vclocks, 404 for other paths
+func riakVclockServer(vclocks map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vclock, ok := vclocks[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Riak-Vclock", vclock)
+	})
+}
+
+func TestRiakRewriteVclock(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		cached string // target vclock remembered for the donor one
+		target string // vclock of the object on target, "" when missing
+		donor  string
+		want   string
+	}{
+		{"cached", "PUT", "t1", "t2", "d1", "t1"},
+		{"target vclock", "PUT", "", "d1", "d1", "d1"},
+		{"donor vclock", "PUT", "", "t1", "d1", "t1"},
+		{"donor vclock on delete", "DELETE", "", "t1", "d1", "t1"},
+		{"stale vclock", "PUT", "", "t1", "d2", "d1"},
+		{"missing on target", "PUT", "", "", "d1", "d1"},
+		{"read", "GET", "", "t1", "d1", "d1"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/buckets/vclocks/keys/k" + strconv.Itoa(i) // riakVclocks is shared by tests
+			targetVclocks, donorVclocks := map[string]string{}, map[string]string{path: tt.donor}
+			if tt.target != "" {
+				targetVclocks[path] = tt.target
+			}
+			target, donors := startTestUpstreams(t, riakMode{opts: newSettings()}, riakVclockServer(targetVclocks), riakVclockServer(donorVclocks), nil)
+			if tt.cached != "" {
+				riakVclocks.Set(vclockKey(target, path, "d1"), tt.cached)
+			}
+
+			r := httptest.NewRequest(tt.method, path, nil)
+			r.Header.Set("X-Riak-Vclock", "d1")
+			riakRewriteVclock(donors, target, r)
+			if got := r.Header.Get("X-Riak-Vclock"); got != tt.want {
+				t.Errorf("vclock %s, want %s", got, tt.want)
+			}
+			if cached, _ := riakVclocks.Get(vclockKey(target, path, "d1")); tt.want != "d1" && cached != tt.want {
+				t.Errorf("remembered vclock %v, want %s", cached, tt.want)
+			}
+		})
+	}
+
+}
+
+// riakSiblingsBody is multipart/mixed body of siblings given as body and Last-Modified pairs, "deleted" body is a tombstone
+func riakSiblingsBody(siblings ...string) (contentType string, body []byte) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for i := 0; i < len(siblings); i += 2 {
+		header := textproto.MIMEHeader{"Content-Type": {"text/plain"}, "Last-Modified": {siblings[i+1]}}
+		if siblings[i] == "deleted" {
+			header.Set("X-Riak-Deleted", "true")
+		}
+		part, _ := writer.CreatePart(header)
+		io.WriteString(part, siblings[i])
+	}
+	writer.Close()
+	return "multipart/mixed; boundary=" + writer.Boundary(), buf.Bytes()
+}
+
+func TestStoreRiakSiblings(t *testing.T) {
+	const (
+		older = "Mon, 02 Jan 2006 15:04:05 GMT"
+		newer = "Tue, 03 Jan 2006 15:04:05 GMT"
+	)
+	tests := []struct {
+		name         string
+		siblings     string
+		siblingsBody []string
+		want         []string // bodies PUT to the target in order
+	}{
+		{"copy", "copy", []string{"v2", newer, "deleted", older, "v1", older}, []string{"v1", "v2"}},
+		{"latest", "latest", []string{"v2", newer, "v1", older}, []string{"v2"}},
+		{"all deleted", "copy", []string{"deleted", older}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var puts []string
+			target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				puts = append(puts, r.Method+" "+r.URL.Path+" "+string(body))
+				w.WriteHeader(http.StatusNoContent)
+			})
+			opts := newSettings()
+			opts.riakSiblings = tt.siblings
+			targetInstance, donors := startTestUpstreams(t, riakMode{opts: opts}, target, newFakeStore(nil), nil)
+			donor, _ := donors.Next()
+
+			contentType, body := riakSiblingsBody(tt.siblingsBody...)
+			spool := opts.newSpool()
+			defer spool.Close()
+			spool.Write(body)
+			resp := &http.Response{StatusCode: http.StatusMultipleChoices, Header: http.Header{"Content-Type": {contentType}}}
+			if _, err := storeRiakSiblings(context.Background(), opts, donor, targetInstance, "/riak/b/k", resp, spool); err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, value := range tt.want {
+				want = append(want, "PUT /buckets/b/keys/k "+value)
+			}
+			if !reflect.DeepEqual(puts, want) {
+				t.Errorf("target got %q, want %q", puts, want)
+			}
+		})
+	}
+}
+
+func TestLoadRiakSiblings(t *testing.T) {
+	contentType, body := riakSiblingsBody("v1", "", "v2", "")
+	tests := []struct {
+		name        string
+		contentType string // of the response the client got
+		body        string
+		donorAsked  bool
+		want        []string
+		wantErr     bool
+	}{
+		{"multipart", contentType, string(body), false, []string{"v1", "v2"}, false},
+		{"vtag list", "text/plain", "Siblings:\nvtag1\nvtag2\n", true, []string{"v1", "v2"}, false},
+		{"bad multipart", "multipart/mixed", "", false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var donorAccept string
+			donor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				donorAccept = r.Header.Get("Accept")
+				w.Header().Set("Content-Type", contentType)
+				w.WriteHeader(http.StatusMultipleChoices)
+				w.Write(body)
+			})
+			opts := newSettings()
+			_, donors := startTestUpstreams(t, riakMode{opts: opts}, newFakeStore(nil), donor, nil)
+			donorInstance, _ := donors.Next()
+
+			spool := opts.newSpool()
+			defer spool.Close()
+			io.WriteString(spool, tt.body)
+			resp := &http.Response{StatusCode: http.StatusMultipleChoices, Header: http.Header{"Content-Type": {tt.contentType}}}
+			siblings, err := loadRiakSiblings(context.Background(), opts, donorInstance, "/buckets/b/keys/k", resp, spool)
+			var got []string
+			for _, s := range siblings {
+				value, _ := s.body.Bytes()
+				got = append(got, string(value))
+				s.body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadRiakSiblings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got siblings %q, want %q", got, tt.want)
+			}
+			if asked := donorAccept == "multipart/mixed"; asked != tt.donorAsked {
+				t.Errorf("donor asked for multipart %v, want %v", asked, tt.donorAsked)
+			}
+		})
+	}
+}
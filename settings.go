@@ -0,0 +1,61 @@
+package main
+
+import (
+	"go.uber.org/zap"
+)
+
+// settings given by command line flags and the stores built from them, made in main
+type settings struct {
+	// dryRun fetches from donors as usual but only logs what would be written to the target
+	dryRun bool
+	// riakSiblings is how donor siblings are copied: "copy" stores all of them, "latest" only the newest one
+	riakSiblings string
+	// riakReturnBody asks target for the stored object on copy, its vclock saves a HEAD request
+	riakReturnBody bool
+	// riakMapRedFill copies keys listed in mapred inputs from a donor before the job runs on the target
+	riakMapRedFill bool
+	// riak2iMaxPages limits continuation pages of a 2i query filled from the donor, 0 for no limit
+	riak2iMaxPages int
+	// riak2iWorkers keys of one 2i result or mapred job filled in parallel
+	riak2iWorkers int
+	// riak2iSlots caps keys filled in parallel by all 2i results and mapred jobs
+	riak2iSlots chan struct{}
+	// riak2iAsync answers the client before the keys are filled
+	riak2iAsync bool
+	// shadowRate is the share of target hits compared with a donor, 0 disables comparison
+	shadowRate float64
+	// shadowHeaders are compared besides status and body
+	shadowHeaders []string
+	// shadowJSON compares JSON bodies by value, so key order and spacing do not matter
+	shadowJSON bool
+	// shadowSlots caps comparisons in progress, requests over it are not compared
+	shadowSlots chan struct{}
+	// spoolMem is response or client body size kept in memory before spilling to a temp file in spoolDir
+	spoolMem int64
+	spoolDir string
+	// missCache remembers keys the donors answered 404 for, nil when disabled
+	missCache *negativeCache
+	// tombstones remembers keys deleted through the proxy, in memory unless a file is given
+	tombstones *tombstoneStore
+	// accessLogger writes one record per client request, nil when disabled
+	accessLogger *zap.Logger
+}
+
+// newSettings returns settings with flag defaults
+func newSettings() *settings {
+	return &settings{
+		riakSiblings:   "copy",
+		riak2iMaxPages: 100,
+		riak2iWorkers:  8,
+		riak2iSlots:    make(chan struct{}, 64),
+		shadowHeaders:  []string{"Content-Type"},
+		shadowSlots:    make(chan struct{}, 16),
+		spoolMem:       8 << 20,
+		tombstones:     newTombstoneStore(),
+	}
+}
+
+// newSpool returns a spool buffer with the spool settings
+func (opts *settings) newSpool() *spoolBuffer {
+	return newSpoolBuffer(opts.spoolMem, opts.spoolDir)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/kzub/trickyproxy/endpoint"
+	"go.uber.org/zap"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const shadowLogBody = 512
+
+// shadowSampled tells if the target hit is compared with a donor, the target body has to be read for it
+func shadowSampled(opts *settings, r *http.Request) bool {
+	return opts.shadowRate > 0 && (r.Method == "GET" || r.Method == "HEAD") && rand.Float64() < opts.shadowRate
+}
+
+// shadowCompare fetches a sampled target hit from a donor in background and logs the differences
+func shadowCompare(opts *settings, donors *endpoint.Instances, r *http.Request, resp *http.Response, body []byte) {
+	select {
+	case opts.shadowSlots <- struct{}{}:
+	default:
+		shadowComparisons.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	rq := r.Clone(context.Background())
+	rq.Body = nil
+	go func() {
+		defer func() { <-opts.shadowSlots }()
+		donor, err := donors.Next()
+		if err != nil {
+			shadowComparisons.WithLabelValues("error").Inc()
+			return
+		}
+		donorResp, donorBody, err := donor.Do(rq)
+		if err != nil {
+			shadowComparisons.WithLabelValues("error").Inc()
+			logError("SHADOW_DONOR", rq, err)
+			return
+		}
+		compareResponses(opts, rq, donor, resp, body, donorResp, donorBody)
+	}()
+}
+
+func compareResponses(opts *settings, r *http.Request, donor *endpoint.Instance, resp *http.Response, body []byte, donorResp *http.Response, donorBody []byte) {
+	mismatch := func(field string, target, donorValue string) {
+		shadowMismatches.WithLabelValues(field).Inc()
+		zap.L().Warn("SHADOW_MISMATCH",
+			zap.String("url", r.URL.String()),
+			zap.String("donor", donor.Name()),
+			zap.String("field", field),
+			zap.String("target", target),
+			zap.String("donor_value", donorValue),
+		)
+	}
+
+	matched := true
+	if resp.StatusCode != donorResp.StatusCode {
+		matched = false
+		mismatch("status", resp.Status, donorResp.Status)
+	}
+	for _, name := range opts.shadowHeaders {
+		target, donorValue := strings.Join(resp.Header.Values(name), ", "), strings.Join(donorResp.Header.Values(name), ", ")
+		if target != donorValue {
+			matched = false
+			mismatch("header "+name, target, donorValue)
+		}
+	}
+	if !sameBody(body, donorBody, opts.shadowJSON) {
+		matched = false
+		mismatch("body", clip(body), clip(donorBody))
+	}
+
+	if matched {
+		shadowComparisons.WithLabelValues("match").Inc()
+		return
+	}
+	shadowComparisons.WithLabelValues("mismatch").Inc()
+}
+
+// sameBody compares bodies byte by byte or, with byValue, as JSON values
+func sameBody(a, b []byte, byValue bool) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	if !byValue {
+		return false
+	}
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func clip(body []byte) string {
+	if len(body) > shadowLogBody {
+		return string(body[:shadowLogBody]) + "..."
+	}
+	return string(body)
+}
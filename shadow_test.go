@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSameBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		byValue bool
+		want    bool
+	}{
+		{"equal", "hello", "hello", false, true},
+		{"different", "hello", "world", false, false},
+		{"json key order by bytes", `{"a":1,"b":2}`, `{"b":2,"a":1}`, false, false},
+		{"json key order by value", `{"a":1,"b":2}`, `{"b":2, "a":1}`, true, true},
+		{"json different value", `{"a":1}`, `{"a":2}`, true, false},
+		{"not json by value", "hello", "world", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameBody([]byte(tt.a), []byte(tt.b), tt.byValue); got != tt.want {
+				t.Errorf("sameBody(%q, %q, %v) = %v, want %v", tt.a, tt.b, tt.byValue, got, tt.want)
+			}
+		})
+	}
+}
+
+// waitShadow returns when comparisons in progress are done, they release their slot at the end
+func waitShadow(opts *settings) {
+	for i := 0; i < cap(opts.shadowSlots); i++ {
+		opts.shadowSlots <- struct{}{}
+	}
+	for i := 0; i < cap(opts.shadowSlots); i++ {
+		<-opts.shadowSlots
+	}
+}
+
+func TestShadowCompare(t *testing.T) {
+	tests := []struct {
+		name       string
+		rate       float64
+		method     string
+		json       bool
+		fullSlots  bool
+		targetBody string
+		donorBody  string
+		donorType  string
+		wantCalls  int32
+		wantResult string // shadow_comparisons label counted once, "" for none
+	}{
+		{"match", 1, "GET", false, false, "hello", "hello", "text/plain", 1, "match"},
+		{"body mismatch", 1, "GET", false, false, "hello", "world", "text/plain", 1, "mismatch"},
+		{"header mismatch", 1, "GET", false, false, "hello", "hello", "application/json", 1, "mismatch"},
+		{"json by value", 1, "GET", true, false, `{"a":1,"b":2}`, `{"b":2,"a":1}`, "text/plain", 1, "match"},
+		{"json by bytes", 1, "GET", false, false, `{"a":1,"b":2}`, `{"b":2,"a":1}`, "text/plain", 1, "mismatch"},
+		{"not sampled", 0, "GET", false, false, "hello", "hello", "text/plain", 0, ""},
+		{"not a read", 1, "PUT", false, false, "hello", "hello", "text/plain", 0, ""},
+		{"slots full", 1, "GET", false, true, "hello", "hello", "text/plain", 0, "dropped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			donor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.Header().Set("Content-Type", tt.donorType)
+				io.WriteString(w, tt.donorBody)
+			})
+			opts := newSettings()
+			opts.shadowRate = tt.rate
+			opts.shadowJSON = tt.json
+			opts.shadowSlots = make(chan struct{}, 1)
+			_, donors := startTestUpstreams(t, httpMode{opts: opts}, newFakeStore(nil), donor, nil)
+
+			var before float64
+			if tt.wantResult != "" {
+				before = testutil.ToFloat64(shadowComparisons.WithLabelValues(tt.wantResult))
+			}
+			if tt.fullSlots {
+				opts.shadowSlots <- struct{}{}
+			}
+			resp := &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{"Content-Type": {"text/plain"}}}
+			if r := httptest.NewRequest(tt.method, "/x/k1", nil); shadowSampled(opts, r) {
+				shadowCompare(opts, donors, r, resp, []byte(tt.targetBody))
+			}
+			if tt.fullSlots {
+				<-opts.shadowSlots
+			}
+			waitShadow(opts)
+
+			if calls := atomic.LoadInt32(&calls); calls != tt.wantCalls {
+				t.Errorf("donor got %d requests, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantResult != "" {
+				if got := testutil.ToFloat64(shadowComparisons.WithLabelValues(tt.wantResult)) - before; got != 1 {
+					t.Errorf("%s comparisons grew by %v, want 1", tt.wantResult, got)
+				}
+			}
+		})
+	}
+}
+
+func TestShadowSkipsNoProxy(t *testing.T) {
+	tests := []struct {
+		path      string
+		wantCalls int
+	}{
+		{"/x/k1", 1},
+		{"/private/k1", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			opts := newSettings()
+			opts.shadowRate = 1
+			target := newFakeStore(map[string]string{tt.path: "hello"})
+			donor := newFakeStore(map[string]string{tt.path: "hello"})
+			proxy := startTestProxy(t, "http", opts, target, donor, RulesConfig{NoProxy: []string{"^/private/"}})
+
+			resp, err := http.Get(proxy.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			proxy.Close() // waits for the handler, it takes a comparison slot after the response is written
+			waitShadow(opts)
+
+			donor.mutex.Lock()
+			defer donor.mutex.Unlock()
+			if len(donor.requests) != tt.wantCalls {
+				t.Errorf("donor got %q, want %d requests", donor.requests, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spoolBuffer keeps written data in memory up to limit and spills it to a temp file in dir above that
+type spoolBuffer struct {
+	limit int64
+	dir   string
+	size  int64
+	mem   bytes.Buffer
+	file  *os.File
+}
+
+// newSpoolBuffer returns empty buffer, dir "" is the system temp dir
+func newSpoolBuffer(limit int64, dir string) *spoolBuffer {
+	return &spoolBuffer{limit: limit, dir: dir}
+}
+
+func (s *spoolBuffer) Write(p []byte) (n int, err error) {
+	if s.file == nil && int64(s.mem.Len()+len(p)) > s.limit {
+		if s.file, err = ioutil.TempFile(s.dir, "trickyproxy-"); err != nil {
+			return 0, err
+		}
+		if _, err = s.file.Write(s.mem.Bytes()); err != nil {
+			return 0, err
+		}
+		s.mem = bytes.Buffer{}
+	}
+
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// Len is the amount of bytes written so far
+func (s *spoolBuffer) Len() int64 {
+	return s.size
+}
+
+// Open returns a new reader positioned at the start of the data
+func (s *spoolBuffer) Open() (io.ReadCloser, error) {
+	if s.file == nil {
+		return ioutil.NopCloser(bytes.NewReader(s.mem.Bytes())), nil
+	}
+	return os.Open(s.file.Name())
+}
+
+// Bytes loads whole data into memory, use for small responses only
+func (s *spoolBuffer) Bytes() ([]byte, error) {
+	if s.file == nil {
+		return s.mem.Bytes(), nil
+	}
+	return ioutil.ReadFile(s.file.Name())
+}
+
+// Close removes temp file if any
+func (s *spoolBuffer) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// clientTee copies data to the spool and to the client, client errors do not stop spooling
+type clientTee struct {
+	client    io.Writer
+	spool     *spoolBuffer
+	clientErr error
+}
+
+func (t *clientTee) Write(p []byte) (int, error) {
+	if n, err := t.spool.Write(p); err != nil {
+		return n, err
+	}
+	if t.clientErr == nil {
+		_, t.clientErr = t.client.Write(p)
+	}
+	return len(p), nil
+}
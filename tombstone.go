@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"github.com/kzub/trickyproxy/endpoint"
+	"go.uber.org/zap"
+	"os"
+	"sort"
+	"sync"
+)
+
+// tombstoneStore is a set of deleted keys, in memory or kept in an append only file:
+// "+key" line adds a tombstone, "-key" removes it
+type tombstoneStore struct {
+	mutex sync.Mutex
+	keys  map[string]struct{}
+	file  *os.File
+}
+
+// newTombstoneStore returns in-memory store, its tombstones are lost on restart
+func newTombstoneStore() *tombstoneStore {
+	return &tombstoneStore{keys: make(map[string]struct{})}
+}
+
+// openTombstones loads tombstones and compacts the file, readOnly store is never written
+func openTombstones(filename string, readOnly bool) (*tombstoneStore, error) {
+	t := newTombstoneStore()
+	file, err := os.Open(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if len(line) < 2 {
+				continue
+			}
+			if line[0] == '+' {
+				t.keys[line[1:]] = struct{}{}
+			} else {
+				delete(t.keys, line[1:])
+			}
+		}
+		file.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	tombstonesSize.Set(float64(len(t.keys)))
+	if readOnly {
+		return t, nil
+	}
+
+	// compact: write live tombstones only, through a temp file
+	keys := make([]string, 0, len(t.keys))
+	for key := range t.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tmp, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, key := range keys {
+		writer.WriteString("+" + key + "\n")
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Rename(filename+".tmp", filename); err != nil {
+		return nil, err
+	}
+
+	t.file, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	zap.L().Info("tombstones loaded",
+		zap.String("file", filename),
+		zap.Int("keys", len(t.keys)),
+	)
+	return t, nil
+}
+
+// tombstoneKey is negativeKey with riak object paths in one form
+func tombstoneKey(target *endpoint.Instance, path string) string {
+	return negativeKey(target, riakKeysPath(path))
+}
+
+// Add records key deleted
+func (t *tombstoneStore) Add(key string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.keys[key]; ok {
+		return
+	}
+	t.keys[key] = struct{}{}
+	t.write("+" + key)
+}
+
+// Remove forgets tombstone, called when the key is written again
+func (t *tombstoneStore) Remove(key string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.keys[key]; !ok {
+		return
+	}
+	delete(t.keys, key)
+	t.write("-" + key)
+}
+
+// Has tells if key was deleted through the proxy
+func (t *tombstoneStore) Has(key string) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.keys[key]
+	return ok
+}
+
+func (t *tombstoneStore) Close() error {
+	if t == nil || t.file == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.file.Close()
+}
+
+func (t *tombstoneStore) write(line string) {
+	tombstonesSize.Set(float64(len(t.keys)))
+	if t.file == nil {
+		return
+	}
+	if _, err := t.file.WriteString(line + "\n"); err != nil {
+		zap.L().Error("TOMBSTONE_WRITE",
+			zap.String("error", err.Error()),
+		)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/kzub/trickyproxy/endpoint"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestTombstoneFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tombstones")
+	store, err := openTombstones(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("a")
+	store.Add("b")
+	store.Add("b")
+	store.Remove("a")
+	store.Remove("c")
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filename); string(data) != "+a\n+b\n-a\n" {
+		t.Fatalf("file has %q, want the changes appended", data)
+	}
+
+	tests := []struct {
+		name     string
+		readOnly bool
+		wantFile string
+	}{
+		{"read only", true, "+a\n+b\n-a\n"},
+		{"compacted", false, "+b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := openTombstones(filename, tt.readOnly)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if store.Has("a") || !store.Has("b") {
+				t.Errorf("got a %v, b %v, want only b", store.Has("a"), store.Has("b"))
+			}
+			if data, _ := ioutil.ReadFile(filename); string(data) != tt.wantFile {
+				t.Errorf("file has %q, want %q", data, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestTombstoneKey(t *testing.T) {
+	target := endpoint.New("127.0.0.1", "8098", "http", "", nil, nil, nil)
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"/riak/b/k", "/buckets/b/keys/k", true},
+		{"/riak/b/k?dw=2", "/buckets/b/keys/k?r=1", true},
+		{"/types/t/buckets/b/keys/k", "/types/t/buckets/b/keys/k?r=1", true},
+		{"/types/t/buckets/b/keys/k", "/buckets/b/keys/k", false},
+		{"/riak/b/k", "/riak/b/k2", false},
+		{"/x/k1", "/x/k1?a=1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			if same := tombstoneKey(target, tt.a) == tombstoneKey(target, tt.b); same != tt.same {
+				t.Errorf("same key %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestRecordTombstone(t *testing.T) {
+	target := endpoint.New("127.0.0.1", "8098", "http", "", nil, nil, nil)
+	tests := []struct {
+		name    string
+		before  bool
+		method  string
+		status  int
+		wantHas bool
+	}{
+		{"delete", false, "DELETE", http.StatusNoContent, true},
+		{"delete missing", false, "DELETE", http.StatusNotFound, true},
+		{"delete failed", false, "DELETE", http.StatusInternalServerError, false},
+		{"put", true, "PUT", http.StatusNoContent, false},
+		{"post", true, "POST", http.StatusOK, false},
+		{"put failed", true, "PUT", http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tombstones := newTombstoneStore()
+			key := tombstoneKey(target, "/buckets/b/keys/k")
+			if tt.before {
+				tombstones.Add(key)
+			}
+			r := httptest.NewRequest(tt.method, "/riak/b/k", nil)
+			recordTombstone(tombstones, target, r, &http.Response{StatusCode: tt.status})
+			if got := tombstones.Has(key); got != tt.wantHas {
+				t.Errorf("tombstone %v, want %v", got, tt.wantHas)
+			}
+		})
+	}
+}
+
+func TestDeleteIsNotResurrected(t *testing.T) {
+	target := newFakeStore(map[string]string{"/x/k1": "hello"})
+	donor := newFakeStore(map[string]string{"/x/k1": "hello"})
+	proxy := startTestProxy(t, "http", newSettings(), target, donor, RulesConfig{})
+
+	rq, _ := http.NewRequest("DELETE", proxy.URL+"/x/k1", nil)
+	resp, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(proxy.URL + "/x/k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after DELETE got %s, want 404", resp.Status)
+	}
+	donor.mutex.Lock()
+	defer donor.mutex.Unlock()
+	if len(donor.requests) != 0 {
+		t.Errorf("donor got %q, want no requests", donor.requests)
+	}
+}
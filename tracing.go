@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// tracer makes spans of request phases, they are dropped until setupTracing installs an exporter
+var tracer = otel.Tracer("github.com/kzub/trickyproxy")
+
+// setupTracing installs exporter "stdout" or "otlp" (OTLP/HTTP to endpoint host:port, OTEL_EXPORTER_OTLP_* env when empty),
+// "" disables tracing. shutdown flushes spans left in the batch
+func setupTracing(exporter, endpoint string, sampleRate float64) (shutdown func(context.Context) error, err error) {
+	var exp sdktrace.SpanExporter
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+		}
+		exp, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, errors.New("UNKNOWN_TRACE_EXPORTER " + exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "trickyproxy"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// startRequestSpan starts the server span of a client request, traceparent of the client is its parent
+func startRequestSpan(r *http.Request, rec *accessRecord) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "proxy "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.RequestURI()),
+			attribute.String("request_id", rec.id),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+func endRequestSpan(span trace.Span, rec *accessRecord) {
+	span.SetAttributes(
+		attribute.String("outcome", string(rec.outcome)),
+		attribute.Int64("retries", atomic.LoadInt64(&rec.retries)),
+	)
+	if accessOutcome(rec.outcome) == "ERROR" {
+		span.SetStatus(codes.Error, string(rec.outcome))
+	}
+	span.End()
+}
+
+// startSpan starts a phase span, upstream calls made with the returned request nest in it
+func startSpan(r *http.Request, name string, attrs ...attribute.KeyValue) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(r.Context(), name, trace.WithAttributes(attrs...))
+	return r.WithContext(ctx), span
+}
+
+// endSpan records upstream status (0 for none) and error of the phase
+func endSpan(span trace.Span, status int, err error) {
+	if status > 0 {
+		span.SetAttributes(attribute.Int("http.status_code", status))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}